@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"loglizer/combiner"
+	"loglizer/manager"
+	"loglizer/processor"
+	"loglizer/reader"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Flags of the analyze command that set the option of the same name as the
+// /analysis query parameters.
+var analysisFlags = []struct {
+	name    string
+	usage   string
+	boolean bool
+}{
+	{"top", "number of most frequent messages reported per window", false},
+	{"window", "window length: day, week or a duration such as 5m", false},
+	{"tz", "time zone to convert timestamps to, such as UTC or Europe/Paris", false},
+	{"format", "log format: auto, csv, json, logfmt, syslog, combined or golog", false},
+	{"templates", "group messages by template: none, mask or drain", false},
+	{"delimiter", "CSV field delimiter of the input and output", false},
+	{"merge", "merge lines of a window that are not contiguous", true},
+	{"skipheader", "skip the first row of the input", true},
+	{"maxline", "length in bytes of the longest input line", false},
+	{"truncate", "cut lines longer than maxline instead of failing", true},
+	{"report", "add a report of the rejected lines to the JSON or NDJSON output", true},
+	{"samples", "number of rejected lines listed in the report (default 10)", false},
+	{"maxerrorrate", "share of rejected lines, between 0 and 1, above which the analysis fails", false},
+	{"header", "write the column names at the top of the CSV output", true},
+}
+
+var outputFormats = map[string]combiner.Format{
+	"csv":    combiner.CSV,
+	"json":   combiner.JSON,
+	"ndjson": combiner.NDJSON,
+}
+
+// runAnalyze summarizes log files, or stdin, and writes the result to a file,
+// or stdout.
+func runAnalyze(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	var inputs stringList
+	flags.Var(&inputs, "in", "input file or glob pattern, - for stdin; may be repeated")
+	out := flags.String("out", "-", "output file, - for stdout")
+	output := flags.String("output", "csv", "output format: csv, json or ndjson")
+	limits := limitFlags(flags)
+	query := url.Values{}
+	for _, analysisFlag := range analysisFlags {
+		flags.Var(&queryFlag{query: query, name: analysisFlag.name, boolean: analysisFlag.boolean}, analysisFlag.name, analysisFlag.usage)
+	}
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: loglizer analyze [flags] [input ...]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := checkLimits(*limits); err != nil {
+		return err
+	}
+
+	options, outputOptions, err := parseOptions(query)
+	if err != nil {
+		return err
+	}
+	format, ok := outputFormats[*output]
+	if !ok {
+		return fmt.Errorf("invalid output: must be csv, json or ndjson")
+	}
+	options.Limits = *limits
+	outputOptions.Format = format
+	if options.Report != nil && format == combiner.CSV {
+		return errReportFormat
+	}
+
+	input, err := openInputs(append(inputs, flags.Args()...), stdin)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resultChan, errChan := startWorkflow(ctx, input, options)
+	wait := sync.OnceValue(func() error { return <-errChan })
+	if options.Report != nil {
+		outputOptions.Report = func() *processor.Report {
+			wait()
+			return options.Report
+		}
+	}
+	write := func(w io.Writer) error {
+		if err := combiner.Write(w, resultChan, outputOptions); err != nil {
+			return err
+		}
+		// The output file is kept only when the whole input was summarized
+		return wait()
+	}
+	if *out == "-" {
+		return write(stdout)
+	}
+	return combiner.WriteFile(*out, write)
+}
+
+// startWorkflow summarizes a single regular file by reading ranges of it in
+// parallel, and any other input as a stream.
+func startWorkflow(ctx context.Context, input io.Reader, options manager.Options) (<-chan processor.Summary, <-chan error) {
+	if file, ok := input.(*os.File); ok {
+		if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+			return manager.StartFileProcessingWorkflow(ctx, file, info.Size(), options)
+		}
+	}
+	return manager.StartLogProcessingWorkflow(ctx, input, options)
+}
+
+// openInputs expands glob patterns and opens every matching file, returning
+// their concatenated content. Files are read in the order given, and in
+// lexical order for the matches of a pattern. No input or "-" stands for
+// stdin. Compressed inputs are decompressed as they are read. A single
+// uncompressed file is returned as the *os.File itself.
+func openInputs(patterns []string, stdin io.Reader) (io.ReadCloser, error) {
+	if len(patterns) == 0 {
+		patterns = []string{"-"}
+	}
+
+	var paths []string
+	for _, pattern := range patterns {
+		if pattern == "-" {
+			paths = append(paths, pattern)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		if matches == nil {
+			// Not a pattern, or a pattern without match: let os.Open report it
+			matches = []string{pattern}
+		}
+		sort.Strings(matches)
+		paths = append(paths, matches...)
+	}
+
+	var readers []io.Reader
+	var closers multiCloser
+	for _, path := range paths {
+		input := stdin
+		if path != "-" {
+			file, err := os.Open(path)
+			if err != nil {
+				closers.Close()
+				return nil, err
+			}
+			if len(paths) == 1 && plainFile(file) {
+				return file, nil
+			}
+			closers = append(closers, file)
+			input = file
+		}
+		decompressed, err := reader.Decompress(input, "")
+		if err != nil {
+			closers.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		closers = append(closers, decompressed)
+		readers = append(readers, newlineTerminated(decompressed))
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(readers...), closers}, nil
+}
+
+// plainFile reports whether file is an uncompressed regular file. Other
+// files, such as pipes, cannot be read at an offset: their compression is
+// detected as they are read.
+func plainFile(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	return !reader.IsCompressedAt(file)
+}
+
+// newlineTerminated adds a line break at the end of r when it does not end
+// with one, so that the last line of a file is not joined with the first line
+// of the next.
+func newlineTerminated(r io.Reader) io.Reader {
+	return &terminatedReader{reader: r}
+}
+
+type terminatedReader struct {
+	reader io.Reader
+	// Whether anything was read, and the last byte read
+	started bool
+	last    byte
+	eof     bool
+	pending bool
+}
+
+func (t *terminatedReader) Read(p []byte) (int, error) {
+	if t.eof {
+		if t.pending && len(p) > 0 {
+			t.pending = false
+			p[0] = '\n'
+			return 1, io.EOF
+		}
+		return 0, io.EOF
+	}
+
+	n, err := t.reader.Read(p)
+	if n > 0 {
+		t.started = true
+		t.last = p[n-1]
+	}
+	if errors.Is(err, io.EOF) {
+		t.eof = true
+		t.pending = t.started && t.last != '\n'
+		if t.pending {
+			// The line break is returned by the next call
+			return n, nil
+		}
+	}
+	return n, err
+}
+
+type multiCloser []io.Closer
+
+func (closers multiCloser) Close() error {
+	var errs []error
+	for _, closer := range closers {
+		errs = append(errs, closer.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// queryFlag is a flag stored as the query parameter of the same name, so
+// that it is validated like the parameters of /analysis requests.
+type queryFlag struct {
+	query   url.Values
+	name    string
+	boolean bool
+}
+
+func (f *queryFlag) String() string {
+	if f.query == nil {
+		return ""
+	}
+	return f.query.Get(f.name)
+}
+
+func (f *queryFlag) Set(value string) error {
+	f.query.Set(f.name, value)
+	return nil
+}
+
+// IsBoolFlag lets boolean options be given without value, as in -merge.
+func (f *queryFlag) IsBoolFlag() bool {
+	return f.boolean
+}
+
+// stringList is a flag that can be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
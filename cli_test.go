@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestRunAnalyze(t *testing.T) {
+	dir := t.TempDir()
+	// Rotated files, the first one without a trailing line break
+	writeFile(t, filepath.Join(dir, "app.log.1"), "2019-04-30T12:01:39+02:00,db.go,Transaction failed")
+	writeFile(t, filepath.Join(dir, "app.log.2"), "2019-04-30T12:01:42+02:00,db.go,Transaction failed\n"+
+		"2019-04-30T13:01:41+02:00,coffeeMachine.go,Coffee is ready\n")
+	out := filepath.Join(dir, "summary.csv")
+
+	err := runAnalyze([]string{"-in", filepath.Join(dir, "app.log.*"), "-out", out, "-header", "-top", "2"}, nil, nil)
+	if err != nil {
+		t.Fatalf("runAnalyze returned an error: %v", err)
+	}
+
+	content, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "date,time,rank,count,share,total,distinct,unparsable,file,message,template\n" +
+		"04302019,12,1,2,1.0000,2,1,0,db.go,Transaction failed,\n" +
+		"04302019,13,1,1,1.0000,1,1,0,coffeeMachine.go,Coffee is ready,\n"
+	if string(content) != expected {
+		t.Errorf("runAnalyze wrote %q, want %q", content, expected)
+	}
+}
+
+func TestRunAnalyzeStdio(t *testing.T) {
+	stdin := strings.NewReader(`{"time":"2019-04-30T12:01:39Z","file":"db.go","msg":"Transaction failed"}`)
+	var stdout bytes.Buffer
+
+	if err := runAnalyze([]string{"-output", "ndjson", "-tz", "UTC"}, stdin, &stdout); err != nil {
+		t.Fatalf("runAnalyze returned an error: %v", err)
+	}
+
+	if !strings.HasPrefix(stdout.String(), `{"start":"2019-04-30T12:00:00Z","end":"2019-04-30T13:00:00Z","total":1,`) {
+		t.Errorf("runAnalyze wrote %q", stdout.String())
+	}
+}
+
+func TestRunAnalyzeErrors(t *testing.T) {
+	tests := [][]string{
+		{"-top", "0"},
+		{"-output", "xml"},
+		{filepath.Join(t.TempDir(), "missing.log")},
+	}
+	for _, args := range tests {
+		if err := runAnalyze(args, strings.NewReader(""), io.Discard); err == nil {
+			t.Errorf("runAnalyze(%q) should have returned an error", args)
+		}
+	}
+}
+
+func TestRunAnalyzeSingleFile(t *testing.T) {
+	content := "timestamp,file,message\n" +
+		"2019-04-30T12:01:39+02:00,db.go,Transaction failed\n" +
+		"2019-04-30T13:01:41+02:00,coffeeMachine.go,Coffee is ready\n" +
+		"2019-04-30T12:01:42+02:00,db.go,Transaction failed"
+	file := filepath.Join(t.TempDir(), "app.log")
+	writeFile(t, file, content)
+
+	// A single file is read in ranges, with the same result as a stream
+	var fromFile, fromStdin bytes.Buffer
+	if err := runAnalyze([]string{"-skipheader", "-merge", file}, nil, &fromFile); err != nil {
+		t.Fatalf("runAnalyze returned an error: %v", err)
+	}
+	if err := runAnalyze([]string{"-skipheader", "-merge"}, strings.NewReader(content), &fromStdin); err != nil {
+		t.Fatalf("runAnalyze returned an error: %v", err)
+	}
+	expected := "04302019,12,1,2,1.0000,2,1,0,db.go,Transaction failed,\n" +
+		"04302019,13,1,1,1.0000,1,1,0,coffeeMachine.go,Coffee is ready,\n"
+	if fromFile.String() != expected || fromStdin.String() != expected {
+		t.Errorf("runAnalyze wrote %q from the file and %q from stdin, want %q", fromFile.String(), fromStdin.String(), expected)
+	}
+}
+
+func TestRunAnalyzeCompressed(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "app.log"), "2019-04-30T12:01:39+02:00,db.go,Transaction failed\n")
+	writeFile(t, filepath.Join(dir, "app.log.1.gz"), gzipped(t, "2019-04-30T12:01:42+02:00,db.go,Transaction failed\n"))
+
+	tests := map[string]string{
+		"app.log.1.gz": "04302019,12,1,1,1.0000,1,1,0,db.go,Transaction failed,\n",
+		"app.log*":     "04302019,12,1,2,1.0000,2,1,0,db.go,Transaction failed,\n",
+	}
+	for pattern, expected := range tests {
+		var stdout bytes.Buffer
+		if err := runAnalyze([]string{filepath.Join(dir, pattern)}, nil, &stdout); err != nil {
+			t.Fatalf("runAnalyze returned an error: %v", err)
+		}
+		if stdout.String() != expected {
+			t.Errorf("runAnalyze %s wrote %q, want %q", pattern, stdout.String(), expected)
+		}
+	}
+}
+
+func TestRunAnalyzeCompressedPipe(t *testing.T) {
+	pipe, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipe.Close()
+	// A pipe named by a path, like the input of a process substitution
+	path := fmt.Sprintf("/proc/self/fd/%d", pipe.Fd())
+	if _, err := os.Stat(path); err != nil {
+		t.Skip("pipes cannot be opened by path:", err)
+	}
+	go func() {
+		writer.Write([]byte(gzipped(t, "2019-04-30T12:01:42+02:00,db.go,Transaction failed\n")))
+		writer.Close()
+	}()
+
+	var stdout bytes.Buffer
+	if err := runAnalyze([]string{path}, nil, &stdout); err != nil {
+		t.Fatalf("runAnalyze returned an error: %v", err)
+	}
+	expected := "04302019,12,1,1,1.0000,1,1,0,db.go,Transaction failed,\n"
+	if stdout.String() != expected {
+		t.Errorf("runAnalyze wrote %q, want %q", stdout.String(), expected)
+	}
+}
+
+func TestRunAnalyzeLineTooLong(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "summary.csv")
+	stdin := strings.NewReader("2019-04-30T12:01:39+02:00,db.go,Transaction failed\n")
+
+	if err := runAnalyze([]string{"-maxline", "20", "-out", out}, stdin, nil); err == nil {
+		t.Fatal("runAnalyze should have returned an error")
+	}
+	// No partial summary is left behind
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("runAnalyze created %s: %v", out, err)
+	}
+}
+
+func TestNewlineTerminated(t *testing.T) {
+	tests := map[string]string{
+		"":                 "",
+		"a\n":              "a\n",
+		"a\nb":             "a\nb\n",
+		"2019-04-30,db.go": "2019-04-30,db.go\n",
+	}
+	for input, expected := range tests {
+		// Read one byte at a time so the line break has to wait for the next call
+		content, err := io.ReadAll(newlineTerminated(iotest.OneByteReader(strings.NewReader(input))))
+		if err != nil || string(content) != expected {
+			t.Errorf("newlineTerminated(%q) read %q, %v; want %q", input, content, err, expected)
+		}
+	}
+}
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
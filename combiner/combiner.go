@@ -1,20 +1,311 @@
 package combiner
 
 import (
-	"log"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"loglizer/processor"
 	"os"
+	"path/filepath"
+	"time"
 )
 
-func WriteProcessedLogsToFile(fileName string, processedLogsChan <-chan string) {
-	file, err := os.Create(fileName)
+// Format is the encoding of the summaries written.
+type Format int
+
+const (
+	CSV Format = iota
+	// A single JSON array holding every summary.
+	JSON
+	// One JSON object per summary and per line.
+	NDJSON
+)
+
+// ContentType returns the media type of the format.
+func (f Format) ContentType() string {
+	switch f {
+	case JSON:
+		return "application/json"
+	case NDJSON:
+		return "application/x-ndjson"
+	}
+	return "text/csv"
+}
+
+type Options struct {
+	Format Format
+	// CSV field delimiter. Defaults to ','.
+	Comma rune
+	// Write the CSV column names before the first record.
+	Header bool
+	// When set, called once every summary has been written to get the report
+	// of rejected lines added to JSON and NDJSON output, unless it returns nil.
+	Report func() *processor.Report
+}
+
+// flusher is implemented by writers that buffer data, such as
+// http.ResponseWriter, and is used to send each summary as soon as it is
+// written.
+type flusher interface {
+	Flush()
+}
+
+// WriteProcessedLogsToFile writes every summary received to the named file,
+// as WriteFile does.
+func WriteProcessedLogsToFile(fileName string, processedLogsChan <-chan processor.Summary, options Options) error {
+	return WriteFile(fileName, func(w io.Writer) error {
+		return Write(w, processedLogsChan, options)
+	})
+}
+
+// WriteFile calls write with a temporary file in the same directory as the
+// named file, which is synced and renamed to it once write succeeds, so the
+// file is never left half written. On error, the temporary file is removed and
+// an existing file is left untouched.
+func WriteFile(fileName string, write func(w io.Writer) error) (err error) {
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(fileName); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	dir, base := filepath.Split(fileName)
+	if dir == "" {
+		dir = "."
+	}
+	file, err := os.CreateTemp(dir, "."+base+".*.tmp")
 	if err != nil {
-		log.Fatalf("failed to create file: %s", err)
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	if err := write(file); err != nil {
+		return fmt.Errorf("failed to write to file: %w", err)
+	}
+	if err := file.Chmod(mode); err != nil {
+		return fmt.Errorf("failed to set file mode: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	if err := os.Rename(file.Name(), fileName); err != nil {
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir makes a rename in dir durable. It is best effort, as directories
+// cannot be synced on every platform.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Write writes every summary received to w in the format of the options.
+func Write(w io.Writer, processedLogsChan <-chan processor.Summary, options Options) error {
+	switch options.Format {
+	case JSON:
+		if options.Report != nil {
+			return WriteJSONReport(w, processedLogsChan, options.Report)
+		}
+		return WriteJSON(w, processedLogsChan)
+	case NDJSON:
+		if err := WriteNDJSON(w, processedLogsChan); err != nil || options.Report == nil {
+			return err
+		}
+		report := options.Report()
+		if report == nil {
+			return nil
+		}
+		return json.NewEncoder(w).Encode(struct {
+			Report jsonReport `json:"report"`
+		}{newJSONReport(report)})
+	}
+	return WriteCSV(w, processedLogsChan, options)
+}
+
+// WriteCSV writes the records of every summary received to w, flushing after
+// each summary so they can be streamed as they arrive. Fields are quoted when
+// needed, so messages containing the delimiter, quotes or line breaks can be
+// read back.
+func WriteCSV(w io.Writer, processedLogsChan <-chan processor.Summary, options Options) error {
+	writer := csv.NewWriter(w)
+	if options.Comma != 0 {
+		writer.Comma = options.Comma
+	}
+
+	if options.Header {
+		if err := writer.Write(processor.Columns); err != nil {
+			return err
+		}
+	}
+	for summary := range processedLogsChan {
+		if err := writer.WriteAll(summary.Records()); err != nil {
+			return err
+		}
+		flush(w)
 	}
-	defer file.Close()
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteJSON writes a JSON array of every summary received to w. Elements are
+// written as they arrive rather than once the array is complete.
+func WriteJSON(w io.Writer, processedLogsChan <-chan processor.Summary) error {
+	if err := writeJSONArray(w, processedLogsChan); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// WriteJSONReport writes a JSON object holding the array of every summary
+// received, as WriteJSON does, followed by the report returned by report once
+// the summaries are written, unless it is nil.
+func WriteJSONReport(w io.Writer, processedLogsChan <-chan processor.Summary, report func() *processor.Report) error {
+	if _, err := io.WriteString(w, `{"summaries":`); err != nil {
+		return err
+	}
+	if err := writeJSONArray(w, processedLogsChan); err != nil {
+		return err
+	}
+	if report := report(); report != nil {
+		data, err := json.Marshal(newJSONReport(report))
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, `,"report":`); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "}\n")
+	return err
+}
+
+func writeJSONArray(w io.Writer, processedLogsChan <-chan processor.Summary) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	separator := ""
+	for summary := range processedLogsChan {
+		data, err := json.Marshal(newJSONSummary(summary))
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, separator); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		separator = ","
+		flush(w)
+	}
+	_, err := io.WriteString(w, "]")
+	return err
+}
 
-	for logEntry := range processedLogsChan {
-		if _, err := file.WriteString(logEntry + "\n"); err != nil {
-			log.Fatalf("failed to write to file: %s", err)
+// WriteNDJSON writes every summary received to w as a JSON object followed by
+// a line break.
+func WriteNDJSON(w io.Writer, processedLogsChan <-chan processor.Summary) error {
+	encoder := json.NewEncoder(w)
+	for summary := range processedLogsChan {
+		if err := encoder.Encode(newJSONSummary(summary)); err != nil {
+			return err
 		}
+		flush(w)
+	}
+	return nil
+}
+
+type jsonSummary struct {
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end"`
+	Total      int            `json:"total"`
+	Distinct   int            `json:"distinct"`
+	Unparsable int            `json:"unparsable"`
+	Top        []jsonLogCount `json:"top"`
+}
+
+type jsonLogCount struct {
+	Rank     int     `json:"rank"`
+	File     string  `json:"file"`
+	Message  string  `json:"message"`
+	Template string  `json:"template,omitempty"`
+	Count    int     `json:"count"`
+	Share    float64 `json:"share"`
+}
+
+func newJSONSummary(summary processor.Summary) jsonSummary {
+	top := make([]jsonLogCount, 0, len(summary.Top))
+	for i, logCount := range summary.Top {
+		top = append(top, jsonLogCount{
+			Rank:     i + 1,
+			File:     logCount.File,
+			Message:  logCount.Message,
+			Template: logCount.Template,
+			Count:    logCount.Count,
+			Share:    logCount.Share,
+		})
+	}
+	return jsonSummary{
+		Start:      summary.Start,
+		End:        summary.End,
+		Total:      summary.Total,
+		Distinct:   summary.Distinct,
+		Unparsable: summary.Unparsable,
+		Top:        top,
+	}
+}
+
+type jsonReport struct {
+	Lines     int                `json:"lines"`
+	Rejected  int                `json:"rejected"`
+	ErrorRate float64            `json:"errorRate"`
+	Reasons   map[string]int     `json:"reasons"`
+	Samples   []jsonRejectedLine `json:"samples"`
+}
+
+type jsonRejectedLine struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+	Text   string `json:"text"`
+}
+
+func newJSONReport(report *processor.Report) jsonReport {
+	reasons := report.Reasons
+	if reasons == nil {
+		reasons = map[string]int{}
+	}
+	samples := make([]jsonRejectedLine, 0, len(report.Samples))
+	for _, sample := range report.Samples {
+		samples = append(samples, jsonRejectedLine{Line: sample.Line, Reason: sample.Reason, Text: sample.Text})
+	}
+	return jsonReport{
+		Lines:     report.Lines,
+		Rejected:  report.Rejected,
+		ErrorRate: report.ErrorRate(),
+		Reasons:   reasons,
+		Samples:   samples,
+	}
+}
+
+func flush(w io.Writer) {
+	if f, ok := w.(flusher); ok {
+		f.Flush()
 	}
 }
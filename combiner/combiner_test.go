@@ -0,0 +1,156 @@
+package combiner
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"loglizer/processor"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWriteCSVRoundTrip(t *testing.T) {
+	summary := processor.Summary{
+		Date:      "04302019",
+		TimeOfDay: "12",
+		Top: []processor.LogCount{
+			{File: "db;v2.go", Message: "Query \"users\" failed,\nrolling back", Count: 3, Share: 0.75},
+			{File: "hal9000.go", Message: "I'm sorry Dave", Count: 1, Share: 0.25},
+		},
+		Total:    4,
+		Distinct: 2,
+	}
+	processedLogsChan := make(chan processor.Summary, 1)
+	processedLogsChan <- summary
+	close(processedLogsChan)
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, processedLogsChan, Options{Comma: ';', Header: true}); err != nil {
+		t.Fatalf("WriteCSV returned an error: %v", err)
+	}
+
+	reader := csv.NewReader(&buf)
+	reader.Comma = ';'
+	records, err := reader.ReadAll()
+	if err != nil {
+		t.Fatalf("failed to read the written CSV: %v", err)
+	}
+
+	expected := append([][]string{processor.Columns}, summary.Records()...)
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("WriteCSV wrote %q, want %q", records, expected)
+	}
+}
+
+func TestWriteProcessedLogsToFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "summary.csv")
+
+	if err := WriteProcessedLogsToFile(fileName, summaries(testSummary), Options{}); err != nil {
+		t.Fatalf("WriteProcessedLogsToFile returned an error: %v", err)
+	}
+
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "04302019,12,1,1,1.0000,1,1,0,db.go,Transaction failed,\n"; string(content) != expected {
+		t.Errorf("WriteProcessedLogsToFile wrote %q, want %q", content, expected)
+	}
+}
+
+func TestWriteProcessedLogsToFileError(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "summary.csv")
+	if err := os.WriteFile(fileName, []byte("previous summary\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A quote is not a valid delimiter, so writing the first record fails
+	if err := WriteProcessedLogsToFile(fileName, summaries(testSummary), Options{Comma: '"'}); err == nil {
+		t.Fatal("WriteProcessedLogsToFile should have returned an error")
+	}
+
+	content, err := os.ReadFile(fileName)
+	if err != nil || string(content) != "previous summary\n" {
+		t.Errorf("the existing file was modified: %q, %v", content, err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("the temporary file was not removed: %v", entries)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	for _, format := range []Format{CSV, JSON, NDJSON} {
+		if err := Write(failingWriter{}, summaries(testSummary), Options{Format: format}); err == nil {
+			t.Errorf("Write with format %d should have returned an error", format)
+		}
+	}
+}
+
+var testSummary = processor.Summary{
+	Date:      "04302019",
+	TimeOfDay: "12",
+	Top:       []processor.LogCount{{File: "db.go", Message: "Transaction failed", Count: 1, Share: 1}},
+	Total:     1,
+	Distinct:  1,
+}
+
+func summaries(s ...processor.Summary) <-chan processor.Summary {
+	processedLogsChan := make(chan processor.Summary, len(s))
+	for _, summary := range s {
+		processedLogsChan <- summary
+	}
+	close(processedLogsChan)
+	return processedLogsChan
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestWriteReport(t *testing.T) {
+	report := &processor.Report{
+		Lines:    2,
+		Rejected: 1,
+		Reasons:  map[string]int{"malformed": 1},
+		Samples:  []processor.RejectedLine{{Line: 2, Reason: "malformed", Text: "not a log line"}},
+	}
+	options := Options{Report: func() *processor.Report { return report }}
+	reportJSON := `{"lines":2,"rejected":1,"errorRate":0.5,"reasons":{"malformed":1},"samples":[{"line":2,"reason":"malformed","text":"not a log line"}]}`
+
+	var buf bytes.Buffer
+	options.Format = JSON
+	if err := Write(&buf, summaries(), options); err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"summaries":[],"report":` + reportJSON + "}\n"; buf.String() != expected {
+		t.Errorf("Write wrote %s, want %s", buf.String(), expected)
+	}
+
+	buf.Reset()
+	options.Format = NDJSON
+	if err := Write(&buf, summaries(), options); err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"report":` + reportJSON + "}\n"; buf.String() != expected {
+		t.Errorf("Write wrote %s, want %s", buf.String(), expected)
+	}
+
+	// No report is written when there is none to give
+	options.Report = func() *processor.Report { return nil }
+	for format, expected := range map[Format]string{JSON: "{\"summaries\":[]}\n", NDJSON: ""} {
+		buf.Reset()
+		options.Format = format
+		if err := Write(&buf, summaries(), options); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != expected {
+			t.Errorf("Write wrote %q without report, want %q", buf.String(), expected)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts the names of the environment variables setting the flags
+// of the serve command, such as LOGLIZER_ADDR for -addr.
+const envPrefix = "LOGLIZER_"
+
+// applyConfig sets the flags that were not given on the command line from
+// their environment variables, or else from the configuration file named by
+// the config flag, a JSON object, YAML mapping or TOML table of flag values by
+// name, decoded according to its extension. Flags take precedence over
+// environment variables, which take precedence over the file.
+func applyConfig(flags *flag.FlagSet, configFlag string) error {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var errs []string
+	flags.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] {
+			return
+		}
+		name := envPrefix + strings.ToUpper(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if err := flags.Set(f.Name, value); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid %s: %s", name, err))
+		}
+		given[f.Name] = true
+	})
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	path := flags.Lookup(configFlag).Value.String()
+	if path == "" {
+		return nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	settings, err := decodeConfig(path, content)
+	if err != nil {
+		return fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	for name, raw := range settings {
+		if flags.Lookup(name) == nil || name == configFlag {
+			return fmt.Errorf("invalid config %s: unknown setting %q", path, name)
+		}
+		if given[name] {
+			continue
+		}
+		value, err := settingValue(raw)
+		if err == nil {
+			err = flags.Set(name, value)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid config %s: %s: %s", path, name, err)
+		}
+	}
+	return nil
+}
+
+// decodeConfig returns the settings of a configuration file by name, decoded
+// as JSON, YAML or TOML according to the extension of path.
+func decodeConfig(path string, content []byte) (map[string]any, error) {
+	var settings map[string]any
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		err = decoder.Decode(&settings)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &settings)
+	case ".toml":
+		err = toml.Unmarshal(content, &settings)
+	default:
+		return nil, fmt.Errorf("must be a .json, .yaml, .yml or .toml file")
+	}
+	return settings, err
+}
+
+// settingValue returns a setting of the configuration file, a string, number
+// or boolean, as given on the command line.
+func settingValue(value any) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	case bool, int, int64, uint64:
+		return fmt.Sprint(value), nil
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64), nil
+	}
+	return "", fmt.Errorf("must be a string, number or boolean")
+}
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// logLevel is the flag setting the lowest level of the messages logged.
+type logLevel slog.Level
+
+func (l *logLevel) String() string {
+	return strings.ToLower(slog.Level(*l).String())
+}
+
+func (l *logLevel) Set(value string) error {
+	level, ok := logLevels[strings.ToLower(value)]
+	if !ok {
+		return fmt.Errorf("must be debug, info, warn or error")
+	}
+	*l = logLevel(level)
+	return nil
+}
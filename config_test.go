@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyConfig(t *testing.T) {
+	configs := map[string]string{
+		"loglizer.json": `{"addr": ":8080", "jobs": 4, "merge": true, "retention": "1h", "memory": "64MiB"}`,
+		"loglizer.yaml": "addr: \":8080\"\njobs: 4\nmerge: true\nretention: 1h\nmemory: 64MiB\n",
+		"loglizer.toml": "addr = \":8080\"\njobs = 4\nmerge = true\nretention = \"1h\"\nmemory = \"64MiB\"\n",
+	}
+	for name, content := range configs {
+		t.Run(name, func(t *testing.T) {
+			config := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(config, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("LOGLIZER_CONFIG", config)
+			t.Setenv("LOGLIZER_JOBS", "3")
+			t.Setenv("LOGLIZER_RETENTION", "2h")
+
+			flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+			flags.String("config", "", "")
+			addr := flags.String("addr", ":15442", "")
+			jobs := flags.Int("jobs", 2, "")
+			merge := flags.Bool("merge", false, "")
+			retention := flags.Duration("retention", 0, "")
+			limits := limitFlags(flags)
+			if err := flags.Parse([]string{"-retention", "3h"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := applyConfig(flags, "config"); err != nil {
+				t.Fatal(err)
+			}
+			// Flags, then environment variables, then the file
+			if *addr != ":8080" || *jobs != 3 || !*merge || *retention != 3*time.Hour || limits.MemoryBudget != 64<<20 {
+				t.Errorf("got addr %q, jobs %d, merge %t, retention %s, memory %d", *addr, *jobs, *merge, *retention, limits.MemoryBudget)
+			}
+		})
+	}
+}
+
+func TestApplyConfigInvalid(t *testing.T) {
+	dir := t.TempDir()
+	invalid := map[string]string{
+		"unknown setting":       `{"port": 8080}`,
+		"invalid value":         `{"jobs": "many"}`,
+		"object value":          `{"addr": {"port": 8080}}`,
+		"not an object":         `[":8080"]`,
+		"list value.yaml":       "addr:\n  - \":8080\"\n",
+		"not a mapping.yml":     "- \":8080\"\n",
+		"invalid TOML.toml":     "addr = :8080\n",
+		"unknown extension.ini": "addr = :8080\n",
+	}
+	for name, content := range invalid {
+		config := filepath.Join(dir, name)
+		if filepath.Ext(name) == "" {
+			config += ".json"
+		}
+		if err := os.WriteFile(config, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+		flags.String("config", config, "")
+		flags.String("addr", "", "")
+		flags.Int("jobs", 0, "")
+		if err := applyConfig(flags, "config"); err == nil || !strings.Contains(err.Error(), config) {
+			t.Errorf("%s: got error %v", name, err)
+		}
+	}
+}
+
+func TestRunServeInvalidConfig(t *testing.T) {
+	tests := map[string]string{
+		"LOGLIZER_WORKERS":     "invalid workers: must be a non-negative integer",
+		"LOGLIZER_WINDOW":      "invalid window: must be day, week or a duration such as 5m",
+		"LOGLIZER_LOGLEVEL":    "invalid LOGLIZER_LOGLEVEL: must be debug, info, warn or error",
+		"LOGLIZER_READTIMEOUT": "invalid readtimeout: must be a non-negative duration",
+	}
+	values := map[string]string{
+		"LOGLIZER_WORKERS":     "-1",
+		"LOGLIZER_WINDOW":      "fortnight",
+		"LOGLIZER_LOGLEVEL":    "verbose",
+		"LOGLIZER_READTIMEOUT": "-1s",
+	}
+	for name, expected := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, values[name])
+			if err := runServe(nil); err == nil || err.Error() != expected {
+				t.Errorf("got error %v, want %q", err, expected)
+			}
+		})
+	}
+}
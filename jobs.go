@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"loglizer/combiner"
+	"loglizer/jobs"
+	"loglizer/reader"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// submitHandler returns the handler of POST /jobs, which stores an upload and
+// queues its analysis with the settings of the server. The job is described
+// in the response, whose Location is the URL of its status. Unless forced, an
+// upload analyzed with the same options before is not queued again: the job
+// that analyzed it is described instead, with status 200.
+func submitHandler(queue *jobs.Queue, settings serverSettings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestQuery := settings.query(r)
+		options, outputOptions, err := parseOptions(requestQuery)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		options.Limits = settings.limits
+		claimedHash, force, err := parseCache(requestQuery)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query := analysisQuery(requestQuery)
+		if claimedHash != "" && !force {
+			// The upload is not read when its job is known
+			if job, ok := queue.Find(claimedHash, query); ok {
+				w.Header().Set("Location", "/jobs/"+job.ID())
+				writeStatus(w, http.StatusOK, job.Status())
+				return
+			}
+		}
+
+		settings.limitBody(w, r)
+		part, err := uploadPart(r)
+		if err == nil {
+			err = reader.CheckEncoding(part.Header.Get("Content-Encoding"))
+		}
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+
+		// The upload is analyzed once received in full, possibly long after
+		// the request ends
+		upload, err := os.CreateTemp("", "loglizer-upload-*")
+		if err != nil {
+			slog.Error("failed to store upload", "err", err)
+			http.Error(w, "Failed to store upload", http.StatusInternalServerError)
+			return
+		}
+		hash := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(upload, hash), part); err != nil {
+			removeFile(upload)
+			writeUploadError(w, err)
+			return
+		}
+		computedHash := hex.EncodeToString(hash.Sum(nil))
+		if claimedHash != "" && claimedHash != computedHash {
+			removeFile(upload)
+			http.Error(w, "invalid sha256: must be the SHA-256 of the file", http.StatusBadRequest)
+			return
+		}
+		if !force {
+			if job, ok := queue.Find(computedHash, query); ok {
+				removeFile(upload)
+				w.Header().Set("Location", "/jobs/"+job.ID())
+				writeStatus(w, http.StatusOK, job.Status())
+				return
+			}
+		}
+		job, err := queue.Submit(jobs.Upload{
+			File:     upload,
+			Encoding: part.Header.Get("Content-Encoding"),
+			Hash:     computedHash,
+			Query:    query,
+		}, options, outputOptions)
+		if err != nil {
+			removeFile(upload)
+			status := http.StatusInternalServerError
+			if errors.Is(err, jobs.ErrQueueFull) || errors.Is(err, jobs.ErrClosed) {
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Location", "/jobs/"+job.ID())
+		writeStatus(w, http.StatusAccepted, job.Status())
+	}
+}
+
+// listHandler returns the handler of GET /jobs, which describes the jobs of
+// an upload, given by the SHA-256 of its content in the hash query parameter,
+// and those whose windows overlap the time range from the from to the to
+// query parameters, given in RFC 3339 format.
+func listHandler(queue *jobs.Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := jobs.Filter{Hash: strings.ToLower(query.Get("hash"))}
+		bounds := []struct {
+			name  string
+			value *time.Time
+		}{{"from", &filter.From}, {"to", &filter.To}}
+		for _, bound := range bounds {
+			if value := query.Get(bound.name); value != "" {
+				var err error
+				if *bound.value, err = time.Parse(time.RFC3339, value); err != nil {
+					http.Error(w, fmt.Sprintf("invalid %s: must be a time in RFC 3339 format", bound.name), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		statuses := queue.List(filter)
+		if statuses == nil {
+			statuses = []jobs.Status{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(statuses); err != nil {
+			slog.Warn("failed to write to response", "err", err)
+		}
+	}
+}
+
+// statusHandler returns the handler of GET /jobs/{id}, which describes a job
+// and its progress.
+func statusHandler(queue *jobs.Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, ok := queue.Status(r.PathValue("id"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeStatus(w, http.StatusOK, status)
+	}
+}
+
+// resultHandler returns the handler of GET /jobs/{id}/result, which writes the
+// summaries of a job like /analysis, following the job while it runs.
+func resultHandler(queue *jobs.Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := queue.Get(r.PathValue("id"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		outputOptions := job.Output()
+		var err error
+		outputOptions.Format, err = negotiateFormat(r.Header.Get("Accept"))
+		if err == nil && outputOptions.Report != nil && outputOptions.Format == combiner.CSV {
+			err = errReportFormat
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			return
+		}
+
+		resultChan, errChan := job.Results(r.Context())
+		writeSummaries(w, resultChan, errChan, outputOptions)
+	}
+}
+
+// deleteHandler returns the handler of DELETE /jobs/{id}, which cancels a job
+// that has not ended and forgets it.
+func deleteHandler(queue *jobs.Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !queue.Delete(r.PathValue("id")) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeStatus(w http.ResponseWriter, code int, status jobs.Status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		slog.Warn("failed to write to response", "err", err)
+	}
+}
+
+func removeFile(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
@@ -0,0 +1,644 @@
+// Package jobs runs analyses of uploaded files in the background, a few at a
+// time, and keeps their summaries in memory or in a Store once they end.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"loglizer/combiner"
+	"loglizer/manager"
+	"loglizer/processor"
+	"loglizer/reader"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultConcurrency is the number of jobs run at the same time when
+// NewQueue is given 0.
+const DefaultConcurrency = 2
+
+// Number of jobs waiting for a runner beyond which submissions are refused.
+const maxQueued = 100
+
+var (
+	// ErrQueueFull is returned by Submit when too many jobs are waiting.
+	ErrQueueFull = errors.New("too many jobs queued")
+	// ErrCancelled ends the results of a cancelled job.
+	ErrCancelled = errors.New("job cancelled")
+	// ErrClosed is returned by Submit once the queue is shut down.
+	ErrClosed = errors.New("job queue shut down")
+)
+
+// State is the stage a job is at.
+type State string
+
+const (
+	Queued    State = "queued"
+	Running   State = "running"
+	Done      State = "done"
+	Failed    State = "failed"
+	Cancelled State = "cancelled"
+)
+
+// Status describes a job and its progress.
+type Status struct {
+	ID    string `json:"id"`
+	State State  `json:"state"`
+	// Error that ended the job, when it failed.
+	Error string `json:"error,omitempty"`
+	// SHA-256 of the upload, in hexadecimal.
+	Hash string `json:"hash,omitempty"`
+	// Query parameters of the analysis, as given to Upload.
+	Query string `json:"query"`
+	// Time range covered by the windows summarized so far.
+	Start *time.Time `json:"start,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+	// Size of the upload and number of its bytes read so far.
+	Size      int64 `json:"size"`
+	BytesRead int64 `json:"bytesRead"`
+	// Number of windows summarized so far, each of them available from
+	// Results.
+	Windows  int        `json:"windows"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// Upload is a file uploaded for analysis.
+type Upload struct {
+	File *os.File
+	// Content-Encoding of the file, or "" to detect its compression.
+	Encoding string
+	// SHA-256 of the file, in hexadecimal.
+	Hash string
+	// Query parameters of the analysis, encoded in canonical form. Uploads
+	// with the same Hash and Query have the same summaries.
+	Query string
+}
+
+// Job is the analysis of an uploaded file.
+type Job struct {
+	id      string
+	options manager.Options
+	output  combiner.Options
+	// Upload, removed once the job ends
+	input    *os.File
+	encoding string
+	hash     string
+	query    string
+	size     int64
+	read     reader.ByteCounter
+
+	mu       sync.Mutex
+	state    State
+	created  time.Time
+	started  time.Time
+	finished time.Time
+	cancel   context.CancelFunc
+	// Summaries emitted so far, in order
+	summaries []processor.Summary
+	err       error
+	// Closed and replaced whenever a summary is added or the job ends
+	changed chan struct{}
+	// Status of a job read from store, whose summaries are only read from it
+	// by Results
+	stored *Status
+	store  *Store
+}
+
+// ID returns the identifier of the job.
+func (j *Job) ID() string {
+	return j.id
+}
+
+// Status returns the state and progress of the job.
+func (j *Job) Status() Status {
+	if j.stored != nil {
+		return *j.stored
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// Bytes near the boundaries of ranges are read twice
+	read := min(j.read.Load(), j.size)
+	status := Status{
+		ID:        j.id,
+		State:     j.state,
+		Hash:      j.hash,
+		Query:     j.query,
+		Size:      j.size,
+		BytesRead: read,
+		Windows:   len(j.summaries),
+		Created:   j.created,
+	}
+	if j.err != nil && j.state == Failed {
+		status.Error = j.err.Error()
+	}
+	if len(j.summaries) > 0 {
+		start, end := j.summaries[0].Start, j.summaries[0].End
+		for _, summary := range j.summaries[1:] {
+			if summary.Start.Before(start) {
+				start = summary.Start
+			}
+			if summary.End.After(end) {
+				end = summary.End
+			}
+		}
+		status.Start, status.End = &start, &end
+	}
+	if started := j.started; !started.IsZero() {
+		status.Started = &started
+	}
+	if finished := j.finished; !finished.IsZero() {
+		status.Finished = &finished
+	}
+	return status
+}
+
+// Results returns the summaries of the job like
+// manager.StartLogProcessingWorkflow: they are sent as they are emitted, and
+// the second channel receives the error that ended the job, or nil once all of
+// them have been sent. Results may be called any number of times, while the
+// job runs or once it has ended. When ctx is done, the channels are closed
+// without waiting for the job.
+func (j *Job) Results(ctx context.Context) (<-chan processor.Summary, <-chan error) {
+	summaries := make(chan processor.Summary)
+	errChan := make(chan error, 1)
+	if j.store != nil {
+		go func() {
+			defer close(summaries)
+			err := j.store.sendSummaries(ctx, j.id, summaries)
+			if err == nil {
+				err = j.err
+			}
+			errChan <- err
+		}()
+		return summaries, errChan
+	}
+	go func() {
+		defer close(summaries)
+		sent := 0
+		for {
+			j.mu.Lock()
+			pending := j.summaries[sent:]
+			ended := j.ended()
+			err := j.err
+			changed := j.changed
+			j.mu.Unlock()
+
+			for _, summary := range pending {
+				select {
+				case summaries <- summary:
+				case <-ctx.Done():
+					errChan <- ctx.Err()
+					return
+				}
+			}
+			sent += len(pending)
+			if ended {
+				errChan <- err
+				return
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				errChan <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return summaries, errChan
+}
+
+// Output returns the options the summaries are to be written with, as given
+// when the job was submitted. When a report was requested in the options of
+// the job, their Report is set to the Report method.
+func (j *Job) Output() combiner.Options {
+	output := j.output
+	if j.options.Report != nil {
+		output.Report = j.Report
+	}
+	return output
+}
+
+// Report returns the report of the lines rejected once the job is done or
+// failed. It is nil while the job runs or once it was cancelled, as its upload
+// may still be being read, and unless one was requested in the options of the
+// job.
+func (j *Job) Report() *processor.Report {
+	if j.stored != nil {
+		return j.options.Report
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.state != Done && j.state != Failed {
+		return nil
+	}
+	return j.options.Report
+}
+
+// ended reports whether the job is over. It must be called with mu held.
+func (j *Job) ended() bool {
+	return j.state == Done || j.state == Failed || j.state == Cancelled
+}
+
+// notify wakes up the readers of the results. It must be called with mu held.
+func (j *Job) notify() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// Queue runs the jobs submitted in order, a few at a time.
+type Queue struct {
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	pending chan *Job
+	closed  bool
+	// Where jobs that ended are kept, when not nil
+	store *Store
+
+	// Context of the running jobs, cancelled when shutting down takes too long
+	ctx     context.Context
+	cancel  context.CancelFunc
+	runners sync.WaitGroup
+}
+
+// NewQueue returns a queue running concurrency jobs at the same time, or
+// DefaultConcurrency when 0. Jobs that end are saved to store and then only
+// read from it, unless store is nil.
+func NewQueue(concurrency int, store *Store) *Queue {
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	q := &Queue{jobs: make(map[string]*Job), pending: make(chan *Job, maxQueued), store: store}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	q.runners.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go q.runJobs()
+	}
+	return q
+}
+
+// HasStore reports whether the jobs that ended are kept in a store rather
+// than in memory.
+func (q *Queue) HasStore() bool {
+	return q.store != nil
+}
+
+// Submit queues the analysis of upload, whose summaries are to be written
+// according to output. The queue owns the file of upload from then on, and
+// removes it once the job ends; when Submit fails, it is left to the caller.
+func (q *Queue) Submit(upload Upload, options manager.Options, output combiner.Options) (*Job, error) {
+	info, err := upload.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{
+		id:       id,
+		options:  options,
+		output:   output,
+		input:    upload.File,
+		encoding: upload.Encoding,
+		hash:     upload.Hash,
+		query:    upload.Query,
+		size:     info.Size(),
+		state:    Queued,
+		created:  time.Now(),
+		changed:  make(chan struct{}),
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, ErrClosed
+	}
+	select {
+	case q.pending <- job:
+	default:
+		return nil, ErrQueueFull
+	}
+	q.jobs[id] = job
+	return job, nil
+}
+
+// Get returns the job of the given ID, from the store once it has ended.
+func (q *Queue) Get(id string) (*Job, bool) {
+	q.mu.Lock()
+	job, ok := q.jobs[id]
+	q.mu.Unlock()
+	if ok || q.store == nil {
+		return job, ok
+	}
+	job, err := q.store.Load(id)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			slog.Error("failed to load job", "id", id, "err", err)
+		}
+		return nil, false
+	}
+	return job, true
+}
+
+// Status returns the status of the job of the given ID, from the index of the
+// store once it has ended.
+func (q *Queue) Status(id string) (Status, bool) {
+	q.mu.Lock()
+	job, ok := q.jobs[id]
+	q.mu.Unlock()
+	if ok {
+		return job.Status(), true
+	}
+	if q.store == nil {
+		return Status{}, false
+	}
+	return q.store.Status(id)
+}
+
+// Find returns a job of the upload with the given hash, analyzed with the
+// same query parameters, that is queued, running or done.
+func (q *Queue) Find(hash, query string) (*Job, bool) {
+	q.mu.Lock()
+	for _, job := range q.jobs {
+		status := job.Status()
+		if status.Hash == hash && status.Query == query && (status.State == Queued || status.State == Running || status.State == Done) {
+			q.mu.Unlock()
+			return job, true
+		}
+	}
+	q.mu.Unlock()
+	if q.store == nil {
+		return nil, false
+	}
+	for _, status := range q.store.List(Filter{Hash: hash}) {
+		if status.Query == query && status.State == Done {
+			return q.Get(status.ID)
+		}
+	}
+	return nil, false
+}
+
+// Add records the summaries of an upload analyzed without the queue, such as
+// while it was received, so that they can be found like those of a job that
+// ran. The upload has no file, and its size is the number of bytes read.
+func (q *Queue) Add(upload Upload, size int64, options manager.Options, output combiner.Options, summaries []processor.Summary, started time.Time) (*Job, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{
+		id:        id,
+		options:   options,
+		output:    output,
+		hash:      upload.Hash,
+		query:     upload.Query,
+		size:      size,
+		created:   started,
+		started:   started,
+		summaries: summaries,
+		changed:   make(chan struct{}),
+	}
+	job.read.Store(size)
+	job.finish(nil)
+
+	q.mu.Lock()
+	q.jobs[id] = job
+	q.mu.Unlock()
+	q.save(job)
+	return job, nil
+}
+
+// List returns the status of the jobs matching filter, oldest first.
+func (q *Queue) List(filter Filter) []Status {
+	q.mu.Lock()
+	var statuses []Status
+	for _, job := range q.jobs {
+		if status := job.Status(); filter.match(status) {
+			statuses = append(statuses, status)
+		}
+	}
+	q.mu.Unlock()
+	if q.store != nil {
+		statuses = append(statuses, q.store.List(filter)...)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Created.Before(statuses[j].Created)
+	})
+	return statuses
+}
+
+// Prune forgets the jobs that ended before the retention period, which
+// starts at now. Nothing is forgotten when retention is 0.
+func (q *Queue) Prune(now time.Time, retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	q.mu.Lock()
+	for id, job := range q.jobs {
+		if status := job.Status(); status.Finished != nil && status.Finished.Before(now.Add(-retention)) {
+			delete(q.jobs, id)
+		}
+	}
+	q.mu.Unlock()
+	if q.store != nil {
+		if err := q.store.Prune(now, retention); err != nil {
+			slog.Error("failed to prune stored jobs", "err", err)
+		}
+	}
+}
+
+// Delete cancels the job of the given ID if it has not ended, and forgets it.
+// It reports whether the job was found.
+func (q *Queue) Delete(id string) bool {
+	q.mu.Lock()
+	job, ok := q.jobs[id]
+	delete(q.jobs, id)
+	q.mu.Unlock()
+	if q.store != nil {
+		stored, err := q.store.Delete(id)
+		if err != nil {
+			slog.Error("failed to delete job", "id", id, "err", err)
+		}
+		ok = ok || stored
+	}
+	if job == nil {
+		return ok
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	switch job.state {
+	case Queued:
+		// Its runner only removes the upload
+		job.finish(ErrCancelled)
+	case Running:
+		job.cancel()
+	}
+	return true
+}
+
+// Shutdown stops the queue: no job is submitted anymore, the queued jobs are
+// cancelled, and it waits for the running jobs to end. When ctx is done first,
+// they are cancelled, and Shutdown returns the error of ctx once they ended.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.pending)
+		for _, job := range q.jobs {
+			job.mu.Lock()
+			if job.state == Queued {
+				// Its runner only removes the upload
+				job.finish(ErrCancelled)
+			}
+			job.mu.Unlock()
+		}
+	}
+	q.mu.Unlock()
+
+	ended := make(chan struct{})
+	go func() {
+		q.runners.Wait()
+		close(ended)
+	}()
+	select {
+	case <-ended:
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		<-ended
+		return ctx.Err()
+	}
+}
+
+func (q *Queue) runJobs() {
+	defer q.runners.Done()
+	for job := range q.pending {
+		job.run(q.ctx)
+		q.save(job)
+	}
+}
+
+// save stores a job that ended, which is then read from the store.
+func (q *Queue) save(job *Job) {
+	if q.store == nil {
+		return
+	}
+	job.mu.Lock()
+	state := job.state
+	job.mu.Unlock()
+	if state == Cancelled {
+		return
+	}
+	if err := q.store.Save(job); err != nil {
+		slog.Error("failed to store job", "id", job.id, "err", err)
+		return
+	}
+	q.mu.Lock()
+	// Unless deleted while being saved
+	_, ok := q.jobs[job.id]
+	delete(q.jobs, job.id)
+	q.mu.Unlock()
+	if !ok {
+		q.store.Delete(job.id)
+	}
+}
+
+// run analyzes the upload of the job until ctx is done, unless it was
+// cancelled while queued.
+func (j *Job) run(ctx context.Context) {
+	defer removeUpload(j.input)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	j.mu.Lock()
+	if j.state != Queued {
+		j.mu.Unlock()
+		return
+	}
+	j.state = Running
+	j.started = time.Now()
+	j.cancel = cancel
+	j.mu.Unlock()
+
+	summaries, errChan := j.start(ctx)
+	for summary := range summaries {
+		j.mu.Lock()
+		j.summaries = append(j.summaries, summary)
+		j.notify()
+		j.mu.Unlock()
+	}
+	err := <-errChan
+	if ctx.Err() != nil {
+		err = ErrCancelled
+	}
+
+	j.mu.Lock()
+	j.finish(err)
+	j.mu.Unlock()
+}
+
+// start starts the workflow summarizing the upload. An uncompressed upload
+// is read in parallel ranges, whose summaries are still received as the
+// ranges before them are read.
+func (j *Job) start(ctx context.Context) (<-chan processor.Summary, <-chan error) {
+	if j.encoding == "" && !reader.IsCompressedAt(j.input) {
+		return manager.StartFileProcessingWorkflow(ctx, j.read.ReaderAt(j.input), j.size, j.options)
+	}
+
+	input, err := reader.Decompress(j.read.Reader(io.NewSectionReader(j.input, 0, j.size)), j.encoding)
+	if err != nil {
+		summaries := make(chan processor.Summary)
+		close(summaries)
+		errChan := make(chan error, 1)
+		errChan <- err
+		return summaries, errChan
+	}
+	// The decompressor is closed once the workflow has ended
+	summaries, errChan := manager.StartLogProcessingWorkflow(ctx, input, j.options)
+	closed := make(chan error, 1)
+	go func() {
+		err := <-errChan
+		input.Close()
+		closed <- err
+	}()
+	return summaries, closed
+}
+
+// finish ends the job with err. It must be called with mu held.
+func (j *Job) finish(err error) {
+	switch {
+	case err == nil:
+		j.state = Done
+	case errors.Is(err, ErrCancelled):
+		j.state = Cancelled
+	default:
+		j.state = Failed
+	}
+	j.err = err
+	j.finished = time.Now()
+	j.notify()
+}
+
+func removeUpload(file *os.File) {
+	file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		slog.Error("failed to remove upload", "err", err)
+	}
+}
+
+func newID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,345 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"loglizer/combiner"
+	"loglizer/manager"
+	"loglizer/processor"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const input = `2019-04-30T12:01:39+02:00,network.go,Network connection established
+2019-04-30T12:01:42+02:00,db.go,Transaction failed
+2019-04-30T12:02:03+02:00,db.go,Transaction failed
+2019-04-30T13:01:41+02:00,coffeeMachine.go,Coffee is ready
+not a log line
+`
+
+func TestQueue(t *testing.T) {
+	queue := NewQueue(1, nil)
+	upload := writeUpload(t, input)
+	job, err := queue.Submit(Upload{File: upload}, manager.Options{Top: 1, Report: &processor.Report{}}, combiner.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := queue.Get(job.ID()); !ok || found != job {
+		t.Fatalf("Get(%q) = %v, %v", job.ID(), found, ok)
+	}
+
+	// Results follow the job until it ends
+	resultChan, errChan := job.Results(context.Background())
+	var messages []string
+	for summary := range resultChan {
+		messages = append(messages, summary.Top[0].Message)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("Results() failed: %v", err)
+	}
+	if len(messages) != 2 || messages[0] != "Transaction failed" || messages[1] != "Coffee is ready" {
+		t.Errorf("Results() sent %q", messages)
+	}
+	if report := job.Report(); report.Rejected != 1 {
+		t.Errorf("Report() = %+v, want 1 rejected line", report)
+	}
+
+	status := job.Status()
+	if status.State != Done || status.Windows != 2 || status.BytesRead != int64(len(input)) || status.Size != int64(len(input)) || status.Finished == nil {
+		t.Errorf("Status() = %+v", status)
+	}
+	// The upload is removed once the job ends
+	waitRemoved(t, upload.Name())
+
+	if !queue.Delete(job.ID()) {
+		t.Errorf("Delete(%q) did not find the job", job.ID())
+	}
+	if _, ok := queue.Get(job.ID()); ok {
+		t.Errorf("Get(%q) found a deleted job", job.ID())
+	}
+}
+
+func TestQueueDeleteQueued(t *testing.T) {
+	// Without runner, jobs stay queued
+	queue := &Queue{jobs: make(map[string]*Job), pending: make(chan *Job, maxQueued)}
+	upload := writeUpload(t, input)
+	job, err := queue.Submit(Upload{File: upload}, manager.Options{Report: &processor.Report{}}, combiner.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := job.Status().State; state != Queued {
+		t.Fatalf("job is %s, want %s", state, Queued)
+	}
+	if job.Output().Report == nil || job.Report() != nil {
+		t.Error("the report of a job that has not ended was given")
+	}
+
+	resultChan, errChan := job.Results(context.Background())
+	queue.Delete(job.ID())
+	for range resultChan {
+		t.Error("Results() sent a summary of a cancelled job")
+	}
+	if err := <-errChan; !errors.Is(err, ErrCancelled) {
+		t.Errorf("Results() failed with %v, want %v", err, ErrCancelled)
+	}
+	if job.Report() != nil {
+		t.Error("the report of a cancelled job was given")
+	}
+
+	// Its runner only removes the upload
+	(<-queue.pending).run(context.Background())
+	if state := job.Status().State; state != Cancelled {
+		t.Errorf("job is %s, want %s", state, Cancelled)
+	}
+	waitRemoved(t, upload.Name())
+}
+
+func TestQueueShutdown(t *testing.T) {
+	// Without runner, jobs stay queued
+	queue := &Queue{jobs: make(map[string]*Job), pending: make(chan *Job, maxQueued)}
+	var jobs []*Job
+	for i := 0; i < 2; i++ {
+		job, err := queue.Submit(Upload{File: writeUpload(t, input)}, manager.Options{}, combiner.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	// Running jobs end once the queue is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	(<-queue.pending).run(ctx)
+	if err := queue.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() failed: %v", err)
+	}
+	for _, job := range jobs {
+		if state := job.Status().State; state != Cancelled {
+			t.Errorf("job %s is %s, want %s", job.ID(), state, Cancelled)
+		}
+	}
+	if _, err := queue.Submit(Upload{File: writeUpload(t, input)}, manager.Options{}, combiner.Options{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Submit() failed with %v, want %v", err, ErrClosed)
+	}
+
+	// Running jobs are waited for
+	queue = NewQueue(1, nil)
+	job, err := queue.Submit(Upload{File: writeUpload(t, input)}, manager.Options{Top: 1}, combiner.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && job.Status().State == Queued; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := queue.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() failed: %v", err)
+	}
+	if state := job.Status().State; state != Done {
+		t.Errorf("job is %s, want %s", state, Done)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	queue := &Queue{jobs: make(map[string]*Job), pending: make(chan *Job, 1)}
+	if _, err := queue.Submit(Upload{File: writeUpload(t, input)}, manager.Options{}, combiner.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Submit(Upload{File: writeUpload(t, input)}, manager.Options{}, combiner.Options{}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Submit() failed with %v, want %v", err, ErrQueueFull)
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := NewQueue(1, store)
+	job, err := queue.Submit(Upload{File: writeUpload(t, input), Hash: "abc"}, manager.Options{Top: 1, Report: &processor.Report{}, Samples: 1}, combiner.Options{Comma: ';', Header: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultChan, errChan := job.Results(context.Background())
+	for range resultChan {
+	}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	// Once saved, the job is only read from the store
+	for i := 0; i < 100 && len(queue.List(Filter{})) != len(store.List(Filter{})); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	expected := job.Status()
+
+	// A partly written description is skipped, and summaries left without
+	// one are removed
+	corrupt := filepath.Join(dir, strings.Repeat("a", 32)+".json")
+	orphan := filepath.Join(dir, strings.Repeat("b", 32)+".summaries.ndjson")
+	for name, content := range map[string]string{corrupt: `{"status":{"id":`, orphan: "{}\n"} {
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Jobs are found once the store is opened again
+	store, err = OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("OpenStore() kept %s: %v", orphan, err)
+	}
+	os.Remove(corrupt)
+	queue = NewQueue(1, store)
+	// Statuses are answered from the index of the store
+	if status, ok := queue.Status(job.ID()); !ok || status.State != Done || status.Windows != 2 || !status.Start.Equal(*expected.Start) {
+		t.Errorf("Status(%q) = %+v, %v, want %+v", job.ID(), status, ok, expected)
+	}
+	if statuses := queue.List(Filter{}); len(statuses) != 1 {
+		t.Errorf("List() = %+v, want the job only", statuses)
+	}
+	stored, ok := queue.Get(job.ID())
+	if !ok {
+		t.Fatalf("Get(%q) did not find the stored job", job.ID())
+	}
+	status := stored.Status()
+	if status.State != Done || status.Hash != "abc" || status.Windows != 2 || !status.Start.Equal(*expected.Start) || !status.End.Equal(*expected.End) {
+		t.Errorf("Status() = %+v, want %+v", status, expected)
+	}
+	if output := stored.Output(); output.Comma != ';' || !output.Header {
+		t.Errorf("Output() = %+v", output)
+	}
+	if report := stored.Report(); report == nil || report.Rejected != 1 || len(report.Samples) != 1 {
+		t.Errorf("Report() = %+v", report)
+	}
+	resultChan, errChan = stored.Results(context.Background())
+	var messages []string
+	for summary := range resultChan {
+		messages = append(messages, summary.Top[0].Message)
+	}
+	if err := <-errChan; err != nil || len(messages) != 2 || messages[0] != "Transaction failed" {
+		t.Errorf("Results() sent %q, %v", messages, err)
+	}
+
+	filters := map[string]Filter{
+		"hash":         {Hash: "abc"},
+		"other hash":   {Hash: "def"},
+		"within range": {From: time.Date(2019, 4, 30, 11, 0, 0, 0, time.UTC), To: time.Date(2019, 4, 30, 11, 30, 0, 0, time.UTC)},
+		"after range":  {From: time.Date(2019, 4, 30, 12, 0, 0, 0, time.UTC)},
+		"before range": {To: time.Date(2019, 4, 30, 10, 0, 0, 0, time.UTC)},
+	}
+	found := map[string]bool{"hash": true, "within range": true}
+	for name, filter := range filters {
+		if statuses := queue.List(filter); (len(statuses) == 1) != found[name] {
+			t.Errorf("List() with %s filter = %+v", name, statuses)
+		}
+	}
+
+	// Jobs are kept for the retention period from their end
+	queue.Prune(status.Finished.Add(time.Hour), 2*time.Hour)
+	if _, ok := queue.Get(job.ID()); !ok {
+		t.Error("Prune() removed a job within the retention period")
+	}
+	queue.Prune(status.Finished.Add(3*time.Hour), 2*time.Hour)
+	if _, ok := queue.Get(job.ID()); ok {
+		t.Error("Prune() kept a job past the retention period")
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 0 {
+		t.Errorf("Prune() left %q", names)
+	}
+}
+
+func TestQueueFind(t *testing.T) {
+	store, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := NewQueue(1, store)
+	summaries := []processor.Summary{{Total: 3}}
+	added, err := queue.Add(Upload{Hash: "abc", Query: "top=2"}, int64(len(input)), manager.Options{}, combiner.Options{}, summaries, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := added.Status(); status.State != Done || status.Windows != 1 || status.BytesRead != int64(len(input)) {
+		t.Errorf("Status() = %+v", status)
+	}
+
+	// Added jobs are saved like those that ran
+	job, ok := queue.Find("abc", "top=2")
+	if !ok || job.ID() != added.ID() {
+		t.Fatalf("Find() = %v, %v, want job %s", job, ok, added.ID())
+	}
+	resultChan, errChan := job.Results(context.Background())
+	var totals []int
+	for summary := range resultChan {
+		totals = append(totals, summary.Total)
+	}
+	if err := <-errChan; err != nil || len(totals) != 1 || totals[0] != 3 {
+		t.Errorf("Results() sent %v, %v", totals, err)
+	}
+	if _, ok := queue.Find("abc", "top=1"); ok {
+		t.Error("Find() found a job of other options")
+	}
+	if _, ok := queue.Find("def", "top=2"); ok {
+		t.Error("Find() found a job of another upload")
+	}
+
+	// Failed jobs are analyzed again
+	job, err = queue.Submit(Upload{File: writeUpload(t, input), Hash: "def"}, manager.Options{Top: 1, MaxErrorRate: 0.1}, combiner.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultChan, errChan = job.Results(context.Background())
+	for range resultChan {
+	}
+	if err := <-errChan; err == nil {
+		t.Fatal("Results() did not fail")
+	}
+	if _, ok := queue.Find("def", ""); ok {
+		t.Error("Find() found a failed job")
+	}
+	waitSaved(t, queue, job.ID())
+}
+
+func writeUpload(t *testing.T, content string) *os.File {
+	t.Helper()
+	file, err := os.Create(filepath.Join(t.TempDir(), "upload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// waitRemoved waits for the runner of a job that ended to remove its upload.
+func waitRemoved(t *testing.T, name string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("%s was not removed", name)
+}
+
+// waitSaved waits for the runner of a job that ended to move it to the store.
+func waitSaved(t *testing.T, queue *Queue, id string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		queue.mu.Lock()
+		_, ok := queue.jobs[id]
+		queue.mu.Unlock()
+		if !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("job %s was not saved", id)
+}
@@ -0,0 +1,283 @@
+package jobs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"loglizer/combiner"
+	"loglizer/manager"
+	"loglizer/processor"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for a job that is not stored.
+var ErrNotFound = errors.New("job not found")
+
+// Job IDs, as made by newID, which are also the names of their files.
+var idPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Filter selects jobs by upload and time range. Zero fields match any job.
+type Filter struct {
+	Hash string
+	// Time range the windows of a job must overlap.
+	From time.Time
+	To   time.Time
+}
+
+func (f Filter) match(status Status) bool {
+	if f.Hash != "" && status.Hash != f.Hash {
+		return false
+	}
+	if f.From.IsZero() && f.To.IsZero() {
+		return true
+	}
+	if status.Start == nil {
+		return false
+	}
+	return (f.To.IsZero() || status.Start.Before(f.To)) && (f.From.IsZero() || status.End.After(f.From))
+}
+
+// Store keeps the jobs that ended in a directory, two files per job: the
+// description of the job in <id>.json and its summaries in
+// <id>.summaries.ndjson. Descriptions are indexed in memory.
+type Store struct {
+	dir string
+
+	mu    sync.Mutex
+	index map[string]Status
+}
+
+// storedJob is the content of the description of a job.
+type storedJob struct {
+	Status  Status            `json:"status"`
+	Comma   rune              `json:"comma"`
+	Header  bool              `json:"header"`
+	Report  *processor.Report `json:"report,omitempty"`
+	Samples int               `json:"samples"`
+}
+
+// OpenStore returns the store of the directory dir, which is created when
+// missing. Jobs whose description cannot be read are skipped, and summaries
+// left without a description, by a crash while a job was saved, are removed.
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{dir: dir, index: make(map[string]Status)}
+	described := make(map[string]bool)
+	for _, name := range names {
+		id := strings.TrimSuffix(filepath.Base(name), ".json")
+		if !idPattern.MatchString(id) {
+			continue
+		}
+		described[id] = true
+		stored, err := s.read(id)
+		if err != nil {
+			slog.Warn("skipping stored job", "id", id, "err", err)
+			continue
+		}
+		s.index[id] = stored.Status
+	}
+
+	names, err = filepath.Glob(filepath.Join(dir, "*.summaries.ndjson"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		id := strings.TrimSuffix(filepath.Base(name), ".summaries.ndjson")
+		if !idPattern.MatchString(id) || described[id] {
+			continue
+		}
+		if err := os.Remove(name); err != nil {
+			slog.Warn("failed to remove summaries without job", "id", id, "err", err)
+		}
+	}
+	return s, nil
+}
+
+// Save stores a job that ended.
+func (s *Store) Save(job *Job) error {
+	status := job.Status()
+	job.mu.Lock()
+	summaries := job.summaries
+	job.mu.Unlock()
+
+	// Summaries are written first, as a job is only listed once described
+	err := combiner.WriteFile(s.path(status.ID, ".summaries.ndjson"), func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		for _, summary := range summaries {
+			if err := encoder.Encode(summary); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	stored := storedJob{
+		Status:  status,
+		Comma:   job.output.Comma,
+		Header:  job.output.Header,
+		Report:  job.options.Report,
+		Samples: job.options.Samples,
+	}
+	err = combiner.WriteFile(s.path(status.ID, ".json"), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(stored)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.index[status.ID] = status
+	s.mu.Unlock()
+	return nil
+}
+
+// Status returns the status of the stored job of the given ID.
+func (s *Store) Status(id string) (Status, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.index[id]
+	return status, ok
+}
+
+// Load returns the stored job of the given ID, which has ended. Its summaries
+// are only read by Results.
+func (s *Store) Load(id string) (*Job, error) {
+	status, ok := s.Status(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	stored, err := s.read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Job{
+		id:      id,
+		options: manager.Options{Report: stored.Report, Samples: stored.Samples},
+		output:  combiner.Options{Comma: stored.Comma, Header: stored.Header},
+		hash:    status.Hash,
+		query:   status.Query,
+		size:    status.Size,
+		state:   status.State,
+		created: status.Created,
+		stored:  &status,
+		store:   s,
+		changed: make(chan struct{}),
+	}
+	if status.Error != "" {
+		job.err = errors.New(status.Error)
+	}
+	return job, nil
+}
+
+// sendSummaries sends the stored summaries of the job of the given ID as they
+// are read, until ctx is done.
+func (s *Store) sendSummaries(ctx context.Context, id string, summaries chan<- processor.Summary) error {
+	file, err := os.Open(s.path(id, ".summaries.ndjson"))
+	if errors.Is(err, os.ErrNotExist) {
+		// Deleted since it was loaded
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var summary processor.Summary
+		if err := json.Unmarshal(scanner.Bytes(), &summary); err != nil {
+			return err
+		}
+		select {
+		case summaries <- summary:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return scanner.Err()
+}
+
+// List returns the status of the stored jobs matching filter.
+func (s *Store) List(filter Filter) []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var statuses []Status
+	for _, status := range s.index {
+		if filter.match(status) {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// Delete removes the stored job of the given ID, and reports whether it was
+// found.
+func (s *Store) Delete(id string) (bool, error) {
+	s.mu.Lock()
+	_, ok := s.index[id]
+	delete(s.index, id)
+	s.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	// Without description, the summaries would no longer be found
+	if err := os.Remove(s.path(id, ".json")); err != nil {
+		return true, err
+	}
+	return true, os.Remove(s.path(id, ".summaries.ndjson"))
+}
+
+// Prune removes the jobs that ended before the retention period, which
+// starts at now. Nothing is removed when retention is 0.
+func (s *Store) Prune(now time.Time, retention time.Duration) error {
+	if retention <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	var expired []string
+	for id, status := range s.index {
+		if status.Finished != nil && status.Finished.Before(now.Add(-retention)) {
+			expired = append(expired, id)
+		}
+	}
+	s.mu.Unlock()
+
+	var errs []error
+	for _, id := range expired {
+		_, err := s.Delete(id)
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Store) read(id string) (storedJob, error) {
+	var stored storedJob
+	content, err := os.ReadFile(s.path(id, ".json"))
+	if err != nil {
+		return stored, err
+	}
+	err = json.Unmarshal(content, &stored)
+	return stored, err
+}
+
+func (s *Store) path(id, extension string) string {
+	return filepath.Join(s.dir, id+extension)
+}
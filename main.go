@@ -1,39 +1,527 @@
 package main
 
 import (
-	"bufio"
-	"log"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"loglizer/combiner"
+	"loglizer/jobs"
 	"loglizer/manager"
+	"loglizer/processor"
+	"loglizer/reader"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	_ "time/tzdata"
 )
 
+const usage = `Usage:
+  loglizer serve [flags]              start the HTTP server (default)
+  loglizer analyze [flags] [input ...] summarize log files
+`
+
 func main() {
-	http.HandleFunc("/analysis", analysisHandler)
-	log.Println("Server starting on port 15442...")
-	log.Fatal(http.ListenAndServe(":15442", nil))
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case "serve":
+		err = runServe(args)
+	case "analyze":
+		err = runAnalyze(args, os.Stdin, os.Stdout)
+	case "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "loglizer %s: %s\n", command, err)
+		os.Exit(1)
+	}
+}
+
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.String("config", "", "JSON, YAML or TOML file setting flags by name, such as {\"addr\": \":8080\"}")
+	addr := flags.String("addr", ":15442", "address to listen on")
+	concurrency := flags.Int("jobs", jobs.DefaultConcurrency, "number of jobs analyzed at the same time")
+	storeDir := flags.String("store", "", "directory where the results of jobs are kept; in memory when empty")
+	retention := flags.Duration("retention", defaultRetention, "time the results of jobs are kept once they end, 0 to keep them")
+	limits := limitFlags(flags)
+	var maxUpload byteSize
+	flags.Var(&maxUpload, "maxupload", "largest request body read, such as 512MiB or 1GB; unlimited when unset")
+	headerTimeout := flags.Duration("headertimeout", 10*time.Second, "time to read the headers of a request, 0 for no limit")
+	readTimeout := flags.Duration("readtimeout", 0, "time to read a whole request, its upload included, 0 for no limit")
+	writeTimeout := flags.Duration("writetimeout", 0, "time to write a response from the end of its request headers, 0 for no limit")
+	idleTimeout := flags.Duration("idletimeout", 2*time.Minute, "time a connection is kept open between requests, 0 for readtimeout")
+	grace := flags.Duration("grace", 30*time.Second, "time running analyses and jobs are given to end on shutdown before they are cancelled")
+	defaults := url.Values{}
+	for _, name := range []string{"format", "window"} {
+		for _, analysisFlag := range analysisFlags {
+			if analysisFlag.name == name {
+				flags.Var(&queryFlag{query: defaults, name: name}, name, "default "+analysisFlag.usage)
+			}
+		}
+	}
+	level := logLevel(slog.LevelInfo)
+	flags.Var(&level, "loglevel", "lowest level of the messages logged: debug, info, warn or error")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: loglizer serve [flags]")
+		fmt.Fprintf(flags.Output(), "Flags are also set by environment variables, such as %sADDR for -addr,\n"+
+			"and by the -config file. Flags take precedence over variables, which take\n"+
+			"precedence over the file.\n", envPrefix)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := applyConfig(flags, "config"); err != nil {
+		return err
+	}
+
+	if *concurrency < 1 {
+		return fmt.Errorf("invalid jobs: must be a positive integer")
+	}
+	if *retention < 0 {
+		return fmt.Errorf("invalid retention: must be a non-negative duration")
+	}
+	if err := checkLimits(*limits); err != nil {
+		return err
+	}
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"headertimeout", *headerTimeout},
+		{"readtimeout", *readTimeout},
+		{"writetimeout", *writeTimeout},
+		{"idletimeout", *idleTimeout},
+		{"grace", *grace},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value < 0 {
+			return fmt.Errorf("invalid %s: must be a non-negative duration", timeout.name)
+		}
+	}
+	// Defaults are checked like the query parameters they stand for
+	if _, _, err := parseOptions(defaults); err != nil {
+		return err
+	}
+	slog.SetLogLoggerLevel(slog.Level(level))
+
+	var store *jobs.Store
+	if *storeDir != "" {
+		var err error
+		if store, err = jobs.OpenStore(*storeDir); err != nil {
+			return err
+		}
+	}
+	queue := jobs.NewQueue(*concurrency, store)
+	if *retention > 0 {
+		go pruneJobs(queue, *retention)
+	}
+
+	// Cancelled once the grace period is over, ending the analyses still running
+	requests, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	server := &http.Server{
+		Addr: *addr,
+		Handler: newServeMux(serverSettings{
+			limits:    *limits,
+			defaults:  defaults,
+			maxUpload: int64(maxUpload),
+		}, queue),
+		ReadHeaderTimeout: *headerTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return requests
+		},
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+	slog.Info("server starting", "addr", *addr)
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+	// A second signal ends the server at once
+	stop()
+	slog.Info("server shutting down", "grace", *grace)
+	shutdown(server, queue, cancelRequests, *grace)
+	return nil
+}
+
+// Time the analyses cancelled on shutdown are given to write their error
+// trailer.
+const cancelTimeout = 5 * time.Second
+
+// shutdown stops server from accepting requests and queue from running jobs,
+// and waits for the requests and jobs in progress to end. Once grace is over,
+// those still running are cancelled with cancelRequests and the queue.
+func shutdown(server *http.Server, queue *jobs.Queue, cancelRequests context.CancelFunc, grace time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	queueErr := make(chan error, 1)
+	go func() {
+		queueErr <- queue.Shutdown(ctx)
+	}()
+
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("cancelling the requests in progress", "err", err)
+		cancelRequests()
+		ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			server.Close()
+		}
+	}
+	if err := <-queueErr; err != nil {
+		slog.Warn("cancelled the running jobs", "err", err)
+	}
+	slog.Info("server stopped")
+}
+
+// defaultRetention is the time the results of jobs are kept by default.
+const defaultRetention = 7 * 24 * time.Hour
+
+// pruneJobs forgets the jobs of queue once retention has passed since they
+// ended, checking at least every hour.
+func pruneJobs(queue *jobs.Queue, retention time.Duration) {
+	ticker := time.NewTicker(min(retention, time.Hour))
+	defer ticker.Stop()
+	for {
+		queue.Prune(time.Now(), retention)
+		<-ticker.C
+	}
+}
+
+// serverSettings are the settings of the server applying to every request.
+type serverSettings struct {
+	limits manager.Limits
+	// Query parameters of the requests that leave them out
+	defaults url.Values
+	// Largest request body read, in bytes, or 0 for no limit
+	maxUpload int64
+}
+
+// query returns the query parameters of r, completed by the defaults.
+func (s serverSettings) query(r *http.Request) url.Values {
+	query := r.URL.Query()
+	for name, values := range s.defaults {
+		if !query.Has(name) {
+			query[name] = values
+		}
+	}
+	return query
+}
+
+// limitBody stops reading the body of r past the largest upload.
+func (s serverSettings) limitBody(w http.ResponseWriter, r *http.Request) {
+	if s.maxUpload > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxUpload)
+	}
+}
+
+// newServeMux returns the handler of the server's routes, analyzing uploads
+// with settings and running jobs on queue.
+func newServeMux(settings serverSettings, queue *jobs.Queue) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/analysis", analysisHandler(settings, queue))
+	mux.Handle("POST /jobs", submitHandler(queue, settings))
+	mux.Handle("GET /jobs", listHandler(queue))
+	mux.Handle("GET /jobs/{id}", statusHandler(queue))
+	mux.Handle("GET /jobs/{id}/result", resultHandler(queue))
+	mux.Handle("DELETE /jobs/{id}", deleteHandler(queue))
+	return mux
 }
 
-func analysisHandler(w http.ResponseWriter, r *http.Request) {
+// analysisErrorTrailer is the trailer holding the error that ended an analysis
+// before the whole upload was summarized.
+const analysisErrorTrailer = "X-Analysis-Error"
+
+// analysisHandler returns the handler of /analysis, which summarizes uploads
+// with the settings of the server. When queue has a store, the summaries of
+// each upload are added to it, to answer later requests for the same upload
+// and options.
+func analysisHandler(settings serverSettings, queue *jobs.Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		analyze(w, r, settings, queue)
+	}
+}
+
+func analyze(w http.ResponseWriter, r *http.Request, settings serverSettings, queue *jobs.Queue) {
 	if r.Method != "POST" {
 		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	file, _, err := r.FormFile("file")
+	requestQuery := settings.query(r)
+	options, outputOptions, err := parseOptions(requestQuery)
 	if err != nil {
-		http.Error(w, "Invalid file", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	options.Limits = settings.limits
+	claimedHash, force, err := parseCache(requestQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	outputOptions.Format, err = negotiateFormat(r.Header.Get("Accept"))
+	if err == nil && options.Report != nil && outputOptions.Format == combiner.CSV {
+		err = errReportFormat
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	query := analysisQuery(requestQuery)
+	if claimedHash != "" && !force {
+		// The upload is not read when its summaries are known
+		if job, ok := queue.Find(claimedHash, query); ok {
+			w.Header().Set("Content-Location", "/jobs/"+job.ID()+"/result")
+			outputOptions.Report = job.Output().Report
+			resultChan, errChan := job.Results(r.Context())
+			writeSummaries(w, resultChan, errChan, outputOptions)
+			return
+		}
+	}
+
+	settings.limitBody(w, r)
+	part, err := uploadPart(r)
+	var file io.ReadCloser
+	// The upload is hashed as read, before it is decompressed
+	hash := sha256.New()
+	var read reader.ByteCounter
+	upload := read.Reader(io.TeeReader(part, hash))
+	if err == nil {
+		file, err = reader.Decompress(upload, part.Header.Get("Content-Encoding"))
+	}
+	if err != nil {
+		writeUploadError(w, err)
 		return
 	}
 	defer file.Close()
+	// Summaries are written while the upload is still being read
+	http.NewResponseController(w).EnableFullDuplex()
+
+	started := time.Now()
+	// The workflow stops as soon as the client goes away
+	resultChan, errChan := manager.StartLogProcessingWorkflow(r.Context(), file, options)
+	if options.Report != nil {
+		outputOptions.Report = func() *processor.Report { return options.Report }
+	}
+	if !queue.HasStore() {
+		// Summaries are only kept on disk, so that memory does not grow with
+		// every upload
+		writeSummaries(w, resultChan, errChan, outputOptions)
+		return
+	}
+	resultChan, collected := collectSummaries(r.Context(), resultChan)
+	if err := writeSummaries(w, resultChan, errChan, outputOptions); err != nil {
+		return
+	}
+	summaries, ok := collected()
+	// Bytes after the end of the compressed data are part of the upload too
+	if _, err := io.Copy(io.Discard, upload); !ok || err != nil {
+		return
+	}
 
-	scanner := bufio.NewScanner(file)
-	resultChan := manager.StartLogProcessingWorkflow(scanner)
+	computedHash := hex.EncodeToString(hash.Sum(nil))
+	if claimedHash != "" && claimedHash != computedHash {
+		slog.Warn("upload does not match its sha256", "sha256", claimedHash, "hash", computedHash)
+	}
+	_, err = queue.Add(jobs.Upload{
+		Encoding: part.Header.Get("Content-Encoding"),
+		Hash:     computedHash,
+		Query:    query,
+	}, read.Load(), options, outputOptions, summaries, started)
+	if err != nil {
+		slog.Error("failed to keep summaries", "err", err)
+	}
+}
 
-	w.Header().Set("Content-Type", "text/csv")
-	for pair := range resultChan {
-		if _, err := w.Write([]byte(pair + "\n")); err != nil {
-			log.Printf("failed to write to response: %s", err)
+// collectSummaries forwards the summaries of resultChan, keeping them until ctx
+// is done. The returned function waits until they are all forwarded and
+// returns them, unless ctx was done first.
+func collectSummaries(ctx context.Context, resultChan <-chan processor.Summary) (<-chan processor.Summary, func() ([]processor.Summary, bool)) {
+	forwarded := make(chan processor.Summary)
+	done := make(chan bool, 1)
+	var summaries []processor.Summary
+	go func() {
+		defer close(forwarded)
+		for summary := range resultChan {
+			select {
+			case forwarded <- summary:
+				summaries = append(summaries, summary)
+			case <-ctx.Done():
+				done <- false
+				return
+			}
+		}
+		done <- true
+	}()
+	return forwarded, func() ([]processor.Summary, bool) {
+		if !<-done {
+			return nil, false
+		}
+		return summaries, true
+	}
+}
+
+// writeSummaries writes the summaries to the response as they are received,
+// followed by the report of outputOptions when set, unless the analysis was
+// cancelled. The status is sent with the first summary: an error received
+// before it is answered with an error status, and one received once they are
+// all written is reported in a trailer. It returns the error that ended the
+// analysis or writing the response.
+func writeSummaries(w http.ResponseWriter, resultChan <-chan processor.Summary, errChan <-chan error, outputOptions combiner.Options) error {
+	wait := sync.OnceValue(func() error { return <-errChan })
+	first, ok := <-resultChan
+	if !ok {
+		if err := wait(); err != nil {
+			slog.Warn("analysis failed", "err", err)
+			writeAnalysisError(w, err)
+			return err
+		}
+	}
+	if report := outputOptions.Report; report != nil {
+		outputOptions.Report = func() *processor.Report {
+			// The lines of a cancelled analysis may still be being read
+			if cancelled(wait()) {
+				return nil
+			}
+			return report()
+		}
+	}
+
+	w.Header().Set("Content-Type", outputOptions.Format.ContentType())
+	w.Header().Set("Trailer", analysisErrorTrailer)
+	summaries := resultChan
+	if ok {
+		stop := make(chan struct{})
+		defer close(stop)
+		summaries = prepend(first, resultChan, stop)
+	}
+	writeErr := combiner.Write(w, summaries, outputOptions)
+	if writeErr != nil {
+		slog.Warn("failed to write to response", "err", writeErr)
+	}
+	if err := wait(); err != nil {
+		slog.Warn("analysis interrupted", "err", err)
+		w.Header().Set(analysisErrorTrailer, err.Error())
+		return err
+	}
+	return writeErr
+}
+
+// prepend returns a channel receiving first and then the summaries of
+// resultChan, until stop is closed.
+func prepend(first processor.Summary, resultChan <-chan processor.Summary, stop <-chan struct{}) <-chan processor.Summary {
+	summaries := make(chan processor.Summary)
+	go func() {
+		defer close(summaries)
+		select {
+		case summaries <- first:
+		case <-stop:
 			return
 		}
+		for summary := range resultChan {
+			select {
+			case summaries <- summary:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return summaries
+}
+
+// writeAnalysisError answers a request whose analysis failed before its first
+// summary.
+func writeAnalysisError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, reader.ErrTooManyRejected), errors.Is(err, reader.ErrLineTooLong):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case cancelled(err), errors.Is(err, jobs.ErrClosed):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, jobs.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		writeUploadError(w, err)
+	}
+}
+
+// cancelled reports whether err tells that an analysis was cancelled rather
+// than ended.
+func cancelled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, jobs.ErrCancelled)
+}
+
+// writeUploadError answers a request whose upload could not be read.
+func writeUploadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("upload too large: must be at most %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, reader.ErrUnsupportedEncoding):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	default:
+		http.Error(w, "Invalid file", http.StatusBadRequest)
+	}
+}
+
+// uploadPart returns the part of the "file" field of a multipart upload, whose
+// content is read from the request body as it is received. A request body
+// compressed as told by its Content-Encoding is decompressed.
+func uploadPart(r *http.Request) (*multipart.Part, error) {
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" {
+		body, err := reader.Decompress(r.Body, encoding)
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+	}
+	parts, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := parts.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
 	}
 }
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"loglizer/combiner"
+	"loglizer/jobs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := map[string]combiner.Format{
+		"":                     combiner.CSV,
+		"text/csv":             combiner.CSV,
+		"*/*":                  combiner.CSV,
+		"application/json":     combiner.JSON,
+		"application/x-ndjson": combiner.NDJSON,
+		"text/html, application/json;q=0.9, */*;q=0.1": combiner.JSON,
+		"application/json;q=0.5, text/csv":             combiner.CSV,
+		"*/*, application/x-ndjson":                    combiner.NDJSON,
+		"application/json, application/x-ndjson":       combiner.JSON,
+	}
+	for accept, expected := range tests {
+		format, err := negotiateFormat(accept)
+		if err != nil || format != expected {
+			t.Errorf("negotiateFormat(%q) = %v, %v; want %v", accept, format, err, expected)
+		}
+	}
+
+	for _, accept := range []string{"text/html", "application/json;q=0"} {
+		if _, err := negotiateFormat(accept); err == nil {
+			t.Errorf("negotiateFormat(%q) should have returned an error", accept)
+		}
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	tests := map[string]int{
+		"1024":    1024,
+		"512KiB":  512 << 10,
+		"64 mib":  64 << 20,
+		"1GB":     1e9,
+		"2g":      2 << 30,
+		"100b":    100,
+		"0":       -1,
+		"1.5GiB":  -1,
+		"lots":    -1,
+		"-3MiB":   -1,
+		"9999GiB": 9999 << 30,
+	}
+	for value, expected := range tests {
+		var size byteSize
+		err := size.Set(value)
+		if expected < 0 {
+			if err == nil {
+				t.Errorf("Set(%q) should have returned an error", value)
+			}
+			continue
+		}
+		if err != nil || int(size) != expected {
+			t.Errorf("Set(%q) = %d, %v, want %d", value, size, err, expected)
+		}
+	}
+}
+
+func TestAnalysisHandler(t *testing.T) {
+	input := `2019-04-30T12:01:39+02:00,network.go,Network connection established
+2019-04-30T12:01:42+02:00,db.go,Transaction failed
+2019-04-30T12:02:03+02:00,db.go,Transaction failed
+2019-04-30T13:01:41+02:00,coffeeMachine.go,Coffee is ready
+`
+
+	t.Run("csv", func(t *testing.T) {
+		recorder := postAnalysis(t, "/analysis", "text/csv", input)
+		expected := "04302019,12,1,2,0.6667,3,2,0,db.go,Transaction failed,\n" +
+			"04302019,13,1,1,1.0000,1,1,0,coffeeMachine.go,Coffee is ready,\n"
+		if recorder.Code != http.StatusOK || recorder.Body.String() != expected {
+			t.Errorf("got %d %q, want 200 %q", recorder.Code, recorder.Body.String(), expected)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		recorder := postAnalysis(t, "/analysis?top=2", "application/json", input)
+		if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", contentType)
+		}
+		var summaries []struct {
+			Start string
+			End   string
+			Total int
+			Top   []struct {
+				Rank    int
+				File    string
+				Message string
+				Count   int
+			}
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &summaries); err != nil {
+			t.Fatalf("invalid JSON response %q: %v", recorder.Body.String(), err)
+		}
+		if len(summaries) != 2 || len(summaries[0].Top) != 2 || summaries[0].Total != 3 {
+			t.Fatalf("unexpected summaries %+v", summaries)
+		}
+		if summaries[0].Start != "2019-04-30T12:00:00+02:00" || summaries[0].End != "2019-04-30T13:00:00+02:00" {
+			t.Errorf("first window = %s to %s", summaries[0].Start, summaries[0].End)
+		}
+		if top := summaries[0].Top[1]; top.Rank != 2 || top.File != "network.go" || top.Count != 1 {
+			t.Errorf("second message of the first window = %+v", top)
+		}
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		recorder := postAnalysis(t, "/analysis", "application/x-ndjson", input)
+		lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("got %d lines, want 2: %q", len(lines), recorder.Body.String())
+		}
+		for _, line := range lines {
+			if !json.Valid([]byte(line)) {
+				t.Errorf("invalid JSON line %q", line)
+			}
+		}
+	})
+
+	t.Run("not acceptable", func(t *testing.T) {
+		recorder := postAnalysis(t, "/analysis", "text/html", input)
+		if recorder.Code != http.StatusNotAcceptable {
+			t.Errorf("got %d, want %d", recorder.Code, http.StatusNotAcceptable)
+		}
+	})
+
+	t.Run("line too long", func(t *testing.T) {
+		// Before the first summary, the error is the status
+		recorder := postAnalysis(t, "/analysis?maxline=60", "text/csv", input)
+		if recorder.Code != http.StatusUnprocessableEntity || recorder.Body.String() != "line 1: line too long\n" {
+			t.Errorf("got %d %q, want %d", recorder.Code, recorder.Body.String(), http.StatusUnprocessableEntity)
+		}
+
+		// After it, a trailer
+		long := "2019-04-30T14:00:00+02:00,db.go," + strings.Repeat("x", 80) + "\n"
+		recorder = postAnalysis(t, "/analysis?maxline=100", "text/csv", input+long)
+		expected := "line 5: line too long"
+		if trailer := recorder.Result().Trailer.Get(analysisErrorTrailer); recorder.Code != http.StatusOK || trailer != expected {
+			t.Errorf("got %d with %s trailer %q, want 200 with %q", recorder.Code, analysisErrorTrailer, trailer, expected)
+		}
+	})
+
+	t.Run("max error rate", func(t *testing.T) {
+		rejected := strings.Repeat("not a log line\n", 1000)
+		recorder := postAnalysis(t, "/analysis?maxerrorrate=0.5", "text/csv", rejected+input)
+		expected := "line 1000: 1000 of 1000 lines rejected: too many rejected lines\n"
+		if recorder.Code != http.StatusUnprocessableEntity || recorder.Body.String() != expected {
+			t.Errorf("got %d %q, want %d %q", recorder.Code, recorder.Body.String(), http.StatusUnprocessableEntity, expected)
+		}
+	})
+
+	t.Run("report", func(t *testing.T) {
+		recorder := postAnalysis(t, "/analysis?report=true", "application/json", "not a log line\n"+input)
+		var response struct {
+			Summaries []json.RawMessage
+			Report    struct {
+				Lines    int
+				Rejected int
+				Samples  []struct {
+					Line int
+					Text string
+				}
+			}
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatalf("invalid JSON response %q: %v", recorder.Body.String(), err)
+		}
+		report := response.Report
+		if len(response.Summaries) != 2 || report.Lines != 5 || report.Rejected != 1 || len(report.Samples) != 1 || report.Samples[0].Line != 1 {
+			t.Errorf("unexpected response %s", recorder.Body.String())
+		}
+
+		recorder = postAnalysis(t, "/analysis?report=true", "text/csv", input)
+		if recorder.Code != http.StatusNotAcceptable {
+			t.Errorf("got %d, want %d for a report in CSV", recorder.Code, http.StatusNotAcceptable)
+		}
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		expected := "04302019,12,1,2,0.6667,3,2,0,db.go,Transaction failed,\n" +
+			"04302019,13,1,1,1.0000,1,1,0,coffeeMachine.go,Coffee is ready,\n"
+		// Detected from the magic bytes of the file
+		recorder := postAnalysis(t, "/analysis", "text/csv", gzipped(t, input))
+		if recorder.Code != http.StatusOK || recorder.Body.String() != expected {
+			t.Errorf("got %d %q, want 200 %q", recorder.Code, recorder.Body.String(), expected)
+		}
+
+		// Told by the Content-Encoding of the request
+		request := uploadRequest(t, "/analysis", "text/csv", input)
+		request.Body = io.NopCloser(strings.NewReader(gzipped(t, readAll(t, request.Body))))
+		request.Header.Set("Content-Encoding", "gzip")
+		recorder = httptest.NewRecorder()
+		analysisHandler(serverSettings{}, jobs.NewQueue(1, nil)).ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK || recorder.Body.String() != expected {
+			t.Errorf("got %d %q, want 200 %q", recorder.Code, recorder.Body.String(), expected)
+		}
+
+		request = uploadRequest(t, "/analysis", "text/csv", input)
+		request.Header.Set("Content-Encoding", "br")
+		recorder = httptest.NewRecorder()
+		analysisHandler(serverSettings{}, jobs.NewQueue(1, nil)).ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("got %d, want %d", recorder.Code, http.StatusUnsupportedMediaType)
+		}
+	})
+
+	t.Run("invalid option", func(t *testing.T) {
+		recorder := postAnalysis(t, "/analysis?top=0", "text/csv", input)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("got %d, want %d", recorder.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("settings", func(t *testing.T) {
+		settings := serverSettings{defaults: url.Values{"window": {"day"}, "format": {"csv"}}}
+		recorder := httptest.NewRecorder()
+		analysisHandler(settings, jobs.NewQueue(1, nil)).ServeHTTP(recorder, uploadRequest(t, "/analysis?format=auto", "text/csv", input))
+		expected := "04302019,,1,2,0.5000,4,3,0,db.go,Transaction failed,\n"
+		if recorder.Code != http.StatusOK || recorder.Body.String() != expected {
+			t.Errorf("got %d %q, want 200 %q", recorder.Code, recorder.Body.String(), expected)
+		}
+
+		settings.maxUpload = 10
+		recorder = httptest.NewRecorder()
+		analysisHandler(settings, jobs.NewQueue(1, nil)).ServeHTTP(recorder, uploadRequest(t, "/analysis", "text/csv", input))
+		if recorder.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("got %d, want %d", recorder.Code, http.StatusRequestEntityTooLarge)
+		}
+	})
+}
+
+func TestJobs(t *testing.T) {
+	input := `2019-04-30T12:01:39+02:00,network.go,Network connection established
+2019-04-30T12:01:42+02:00,db.go,Transaction failed
+2019-04-30T13:01:41+02:00,coffeeMachine.go,Coffee is ready
+`
+	server := httptest.NewServer(newServeMux(serverSettings{}, jobs.NewQueue(1, nil)))
+	defer server.Close()
+
+	request := uploadRequest(t, server.URL+"/jobs?top=1", "", gzipped(t, input))
+	request.RequestURI = ""
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status jobs.Status
+	json.NewDecoder(response.Body).Decode(&status)
+	response.Body.Close()
+	if response.StatusCode != http.StatusAccepted || response.Header.Get("Location") != "/jobs/"+status.ID {
+		t.Fatalf("POST /jobs: got %d %+v, Location %q", response.StatusCode, status, response.Header.Get("Location"))
+	}
+
+	// The result follows the job until it ends
+	response, err = http.Get(server.URL + "/jobs/" + status.ID + "/result")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readAll(t, response.Body)
+	response.Body.Close()
+	expected := "04302019,12,1,1,0.5000,2,2,0,network.go,Network connection established,\n" +
+		"04302019,13,1,1,1.0000,1,1,0,coffeeMachine.go,Coffee is ready,\n"
+	if response.StatusCode != http.StatusOK || body != expected || response.Trailer.Get(analysisErrorTrailer) != "" {
+		t.Errorf("GET result: got %d %q, trailer %q; want 200 %q", response.StatusCode, body, response.Trailer.Get(analysisErrorTrailer), expected)
+	}
+
+	response, err = http.Get(server.URL + "/jobs/" + status.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(response.Body).Decode(&status)
+	response.Body.Close()
+	if status.State != jobs.Done || status.Windows != 2 || status.BytesRead != status.Size {
+		t.Errorf("GET status: got %+v", status)
+	}
+
+	response, err = http.Get(server.URL + "/jobs?hash=" + status.Hash + "&from=2019-04-30T11:30:00%2B02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []jobs.Status
+	json.NewDecoder(response.Body).Decode(&statuses)
+	response.Body.Close()
+	if len(statuses) != 1 || statuses[0].ID != status.ID {
+		t.Errorf("GET /jobs: got %+v", statuses)
+	}
+
+	request, _ = http.NewRequest(http.MethodDelete, server.URL+"/jobs/"+status.ID, nil)
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE: got %d, want %d", response.StatusCode, http.StatusNoContent)
+	}
+	response, err = http.Get(server.URL + "/jobs/" + status.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("GET deleted job: got %d, want %d", response.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestAnalysisCache(t *testing.T) {
+	input := `2019-04-30T12:01:39+02:00,network.go,Network connection established
+2019-04-30T13:01:41+02:00,coffeeMachine.go,Coffee is ready
+`
+	hash := sha256.Sum256([]byte(input))
+	sum := hex.EncodeToString(hash[:])
+	store, err := jobs.OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := jobs.NewQueue(1, store)
+	// Until its runners have saved their jobs
+	t.Cleanup(func() { queue.Shutdown(context.Background()) })
+	handler := newServeMux(serverSettings{}, queue)
+	post := func(target, content string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, uploadRequest(t, target, "text/csv", content))
+		return recorder
+	}
+
+	// Without a store, analyses are not kept
+	uncached := newServeMux(serverSettings{}, jobs.NewQueue(1, nil))
+	for _, content := range []string{input, "not a log line\n"} {
+		recorder := httptest.NewRecorder()
+		uncached.ServeHTTP(recorder, uploadRequest(t, "/analysis?top=2&sha256="+sum, "text/csv", content))
+		if recorder.Header().Get("Content-Location") != "" {
+			t.Errorf("analysis without store: Content-Location %q", recorder.Header().Get("Content-Location"))
+		}
+	}
+
+	first := post("/analysis?top=2", input)
+	if first.Code != http.StatusOK || first.Header().Get("Content-Location") != "" {
+		t.Fatalf("first analysis: got %d, Content-Location %q", first.Code, first.Header().Get("Content-Location"))
+	}
+
+	// The upload is not read when its hash is known: it would not parse
+	cached := post("/analysis?top=2&sha256="+strings.ToUpper(sum), "not a log line\n")
+	if cached.Body.String() != first.Body.String() || !strings.HasPrefix(cached.Header().Get("Content-Location"), "/jobs/") {
+		t.Errorf("cached analysis: got %q, Content-Location %q; want %q", cached.Body.String(), cached.Header().Get("Content-Location"), first.Body.String())
+	}
+	forced := post("/analysis?top=2&force=true&sha256="+sum, "not a log line\n")
+	if forced.Body.String() == first.Body.String() || forced.Header().Get("Content-Location") != "" {
+		t.Errorf("forced analysis: got %q, Content-Location %q", forced.Body.String(), forced.Header().Get("Content-Location"))
+	}
+	if other := post("/analysis?top=1&sha256="+sum, "not a log line\n"); other.Header().Get("Content-Location") != "" {
+		t.Errorf("analysis with other options: Content-Location %q", other.Header().Get("Content-Location"))
+	}
+
+	// Jobs of an upload analyzed before are not queued again
+	submitted := post("/jobs?top=2", gzipped(t, input))
+	if submitted.Code != http.StatusAccepted {
+		t.Errorf("POST /jobs of a compressed upload: got %d, want %d", submitted.Code, http.StatusAccepted)
+	}
+	submitted = post("/jobs?top=2", input)
+	if submitted.Code != http.StatusOK || submitted.Header().Get("Location")+"/result" != cached.Header().Get("Content-Location") {
+		t.Errorf("POST /jobs: got %d, Location %q", submitted.Code, submitted.Header().Get("Location"))
+	}
+	if mismatch := post("/jobs?top=3&sha256="+sum, "not a log line\n"); mismatch.Code != http.StatusBadRequest {
+		t.Errorf("POST /jobs with another sha256: got %d, want %d", mismatch.Code, http.StatusBadRequest)
+	}
+	if invalid := post("/analysis?sha256=abc", input); invalid.Code != http.StatusBadRequest {
+		t.Errorf("invalid sha256: got %d, want %d", invalid.Code, http.StatusBadRequest)
+	}
+}
+
+func postAnalysis(t *testing.T, target, accept, content string) *httptest.ResponseRecorder {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	analysisHandler(serverSettings{}, jobs.NewQueue(1, nil)).ServeHTTP(recorder, uploadRequest(t, target, accept, content))
+	return recorder
+}
+
+// uploadRequest returns a request uploading content as the file of a form.
+func uploadRequest(t *testing.T, target, accept, content string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", "journaux.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(content))
+	writer.Close()
+
+	request := httptest.NewRequest(http.MethodPost, target, &body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	request.Header.Set("Accept", accept)
+	return request
+}
+
+func gzipped(t *testing.T, content string) string {
+	t.Helper()
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	return compressed.String()
+}
+
+func readAll(t *testing.T, r io.Reader) string {
+	t.Helper()
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
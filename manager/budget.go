@@ -0,0 +1,53 @@
+package manager
+
+import (
+	"context"
+	"sync"
+)
+
+// budget bounds the number of bytes of log lines held by the workflow. A
+// batch larger than the whole budget is let through once nothing else is
+// held, so that a huge window slows the workflow down instead of blocking it.
+type budget struct {
+	mu        sync.Mutex
+	size      int
+	available int
+	// Closed and replaced whenever bytes are released.
+	released chan struct{}
+}
+
+func newBudget(size int) *budget {
+	return &budget{size: size, available: size, released: make(chan struct{})}
+}
+
+// acquire waits until n bytes are available and takes them. It reports false
+// when ctx is done first.
+func (b *budget) acquire(ctx context.Context, n int) bool {
+	n = min(n, b.size)
+	for {
+		b.mu.Lock()
+		if n <= b.available {
+			b.available -= n
+			b.mu.Unlock()
+			return true
+		}
+		released := b.released
+		b.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// release gives back n bytes taken by acquire.
+func (b *budget) release(n int) {
+	n = min(n, b.size)
+	b.mu.Lock()
+	b.available += n
+	close(b.released)
+	b.released = make(chan struct{})
+	b.mu.Unlock()
+}
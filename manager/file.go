@@ -0,0 +1,304 @@
+package manager
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"loglizer/processor"
+	"loglizer/reader"
+	"sort"
+	"sync"
+)
+
+const (
+	// Bounds of the number of bytes of a file read at a time by each goroutine
+	// of StartFileProcessingWorkflow.
+	minRangeSize = 1024 * 1024
+	maxRangeSize = 64 * 1024 * 1024
+
+	// Number of ranges per goroutine that may be read ahead of the first range
+	// not merged yet.
+	rangesPerWorker = 2
+)
+
+// rangeResult is what was read from a range of a file.
+type rangeResult struct {
+	// Position of the range in the file, starting at 0
+	index   int
+	windows []processor.Result
+	// Lines rejected before the first window of the range
+	leading int
+	// Records read, the header included
+	records int
+	report  processor.Report
+	err     error
+}
+
+// StartFileProcessingWorkflow summarizes the size bytes of file like
+// StartLogProcessingWorkflow, but splits it into ranges of lines that are read
+// and counted in parallel, so that reading is not bound to a single core.
+// Ranges are merged in input order as they are read, and every window before
+// the last one read is sent as soon as the ranges before it are merged. The
+// ranges read ahead are bounded so that their counts fit in
+// Limits.MemoryBudget, unless windows are merged, in which case summaries are
+// only sent once the whole file is read.
+//
+// Ranges start at the beginning of a line. For formats whose records may span
+// several lines, such as CSV with quoted fields, they start at a line the
+// parser accepts following another one with balanced quotes, which a quoted
+// field holding whole records could still defeat.
+func StartFileProcessingWorkflow(ctx context.Context, file io.ReaderAt, size int64, options Options) (<-chan processor.Summary, <-chan error) {
+	rangeSize := options.rangeSize()
+	n := int(max((size+rangeSize-1)/rangeSize, 1))
+	return summarizeRanges(ctx, file, size, n, options)
+}
+
+// rangeSize returns the number of bytes of a file read at a time by each
+// goroutine, so that the counts of the ranges read ahead fit in the memory
+// budget.
+func (l Limits) rangeSize() int64 {
+	memoryBudget := l.MemoryBudget
+	if memoryBudget <= 0 {
+		memoryBudget = DefaultMemoryBudget
+	}
+	return min(max(int64(memoryBudget/(rangesPerWorker*l.workers())), minRangeSize), maxRangeSize)
+}
+
+// summarizeRanges summarizes file read in at most n ranges.
+func summarizeRanges(ctx context.Context, file io.ReaderAt, size int64, n int, options Options) (<-chan processor.Summary, <-chan error) {
+	queueSize := options.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	windowsChan := make(chan processor.Result)
+	processedLogsChan := make(chan processor.Summary, queueSize)
+	readErrChan := make(chan error, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		defer close(windowsChan)
+		readErrChan <- readRanges(ctx, file, size, n, &options, windowsChan)
+	}()
+
+	go func() {
+		summaryOptions := processor.Options{Top: options.Top, Window: options.Window, Templates: options.Templates}
+		summarizeInOrder(ctx, windowsChan, processedLogsChan, options.workers(), summaryOptions)
+		close(processedLogsChan)
+		err := <-readErrChan
+		if err == nil {
+			// Windows read may have been dropped after reading ended
+			err = ctx.Err()
+		}
+		errChan <- err
+	}()
+
+	return processedLogsChan, errChan
+}
+
+// readRanges counts the windows of file in at most n ranges read in parallel,
+// merges them in input order and sends the complete ones. When reading a range
+// ends early, the windows of the ranges before it and those it read are sent
+// and the reason is returned, the lines of the ranges after it being ignored
+// as a sequential read would not have reached them.
+func readRanges(ctx context.Context, file io.ReaderAt, size int64, n int, options *Options, windowsChan chan<- processor.Result) error {
+	parser := options.Parser
+	if parser == nil {
+		sample := bufio.NewReaderSize(io.NewSectionReader(file, 0, size), detectionSampleSize)
+		parser = processor.DetectParser(sampleLines(sample))
+	}
+	offsets, err := reader.SplitRanges(file, size, n, parser)
+	if err != nil {
+		return err
+	}
+	ranges := len(offsets) - 1
+	workers := min(options.workers(), ranges)
+
+	var wg sync.WaitGroup
+	// Workers are done with the file once reading is cancelled
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// A slot is taken by every range read until it is merged
+	inFlight := make(chan struct{}, rangesPerWorker*workers)
+	indexes := make(chan int)
+	results := make(chan rangeResult, cap(inFlight))
+	go func() {
+		defer close(indexes)
+		for i := 0; i < ranges; i++ {
+			select {
+			case inFlight <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case indexes <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results <- readRange(ctx, file, offsets, i, parser, options)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	report := options.Report
+	if report == nil {
+		report = &processor.Report{}
+	}
+	// Windows not sent yet: the last one read, which the next range may
+	// continue, or all of them when merging
+	var windows []processor.Result
+	pending := make(map[int]rangeResult)
+	next := 0
+	lineOffset := 0
+	leading := 0
+	for result := range results {
+		pending[result.index] = result
+		for {
+			result, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			<-inFlight
+			next++
+
+			report.Merge(result.report, lineOffset, options.Samples)
+			if report.Lines >= reader.MinErrorRateLines {
+				if err := reader.CheckErrorRate(report, options.MaxErrorRate); err != nil {
+					// The input is rejected rather than cut, so the windows
+					// not sent yet are dropped
+					return &reader.LineError{Line: lineOffset + result.records, Err: err}
+				}
+			}
+			windows, leading = appendRange(windows, result, leading, options.Merge)
+			if result.err != nil {
+				var lineErr *reader.LineError
+				if errors.As(result.err, &lineErr) {
+					lineErr.Line += lineOffset
+				}
+				if options.Merge {
+					windows = mergeWindows(windows)
+				}
+				if !sendWindows(ctx, windowsChan, windows) {
+					return ctx.Err()
+				}
+				return result.err
+			}
+			lineOffset += result.records
+
+			if !options.Merge && len(windows) > 1 {
+				// Every window but the last one is complete
+				if !sendWindows(ctx, windowsChan, windows[:len(windows)-1]) {
+					return ctx.Err()
+				}
+				windows = []processor.Result{windows[len(windows)-1]}
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if options.Merge {
+		windows = mergeWindows(windows)
+	}
+	if !sendWindows(ctx, windowsChan, windows) {
+		return ctx.Err()
+	}
+	return reader.CheckErrorRate(report, options.MaxErrorRate)
+}
+
+// readRange counts the windows of the range of file starting at offsets[i].
+func readRange(ctx context.Context, file io.ReaderAt, offsets []int64, i int, parser processor.Parser, options *Options) rangeResult {
+	result := rangeResult{index: i}
+	scanner := bufio.NewScanner(io.NewSectionReader(file, offsets[i], offsets[i+1]-offsets[i]))
+	result.windows, result.leading, result.records, result.err = reader.CountWindows(ctx, scanner, reader.Options{
+		Parser:        parser,
+		Window:        options.Window,
+		Location:      options.Location,
+		Merge:         options.Merge,
+		SkipHeader:    options.SkipHeader && i == 0,
+		MaxLineLength: options.MaxLineLength,
+		Truncate:      options.Truncate,
+		Report:        &result.report,
+		Samples:       options.Samples,
+	}, options.Templates)
+	return result
+}
+
+// sendWindows reports whether windows were all sent before ctx was done.
+func sendWindows(ctx context.Context, windowsChan chan<- processor.Result, windows []processor.Result) bool {
+	for _, window := range windows {
+		select {
+		case windowsChan <- window:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// appendRange adds the windows of a range to those of the ranges before it
+// not sent yet, joining the windows split by the boundary between them. Lines
+// rejected before any window are counted in the last window before them, or
+// else the first one after them: it returns those still waiting for a window.
+func appendRange(windows []processor.Result, result rangeResult, leading int, merge bool) ([]processor.Result, int) {
+	next := result.windows
+	leading += result.leading
+	switch {
+	case len(windows) > 0:
+		windows[len(windows)-1].Unparsable += leading
+		leading = 0
+	case len(next) > 0:
+		next[0].Unparsable += leading
+		leading = 0
+	}
+	if !merge && len(windows) > 0 && len(next) > 0 && windows[len(windows)-1].Start.Equal(next[0].Start) {
+		windows[len(windows)-1].Merge(next[0])
+		next = next[1:]
+	}
+	seq := 0
+	if len(windows) > 0 {
+		seq = windows[len(windows)-1].Seq + 1
+	}
+	for i, window := range next {
+		window.Seq = seq + i
+		windows = append(windows, window)
+	}
+	return windows, leading
+}
+
+// mergeWindows merges the windows of the same start, keeping the counts of
+// each in input order, and sorts them chronologically.
+func mergeWindows(windows []processor.Result) []processor.Result {
+	byStart := make(map[int64]int)
+	var merged []processor.Result
+	for _, window := range windows {
+		if i, ok := byStart[window.Start.Unix()]; ok {
+			merged[i].Merge(window)
+			continue
+		}
+		byStart[window.Start.Unix()] = len(merged)
+		merged = append(merged, window)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Start.Before(merged[j].Start)
+	})
+	for i := range merged {
+		merged[i].Seq = i
+	}
+	return merged
+}
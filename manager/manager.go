@@ -2,38 +2,330 @@ package manager
 
 import (
 	"bufio"
+	"context"
+	"io"
 	"loglizer/processor"
 	"loglizer/reader"
+	"loglizer/window"
 	"runtime"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
-	logsChanSize          = 10000000
-	processedLogsChanSize = 1000000
+	// Default number of batches waiting for a worker, and of summaries
+	// waiting to be written.
+	DefaultQueueSize = 4
+	// Default number of bytes of log lines read but not yet summarized.
+	DefaultMemoryBudget = 256 * 1024 * 1024
+
+	// Maximum number of windows that may be read but not yet emitted. It bounds
+	// the reorder buffer when a slow window holds back the ones behind it.
+	maxBatchesInFlight = 64
+
+	// Number of bytes of lines after which a window is split into parts
+	// counted in parallel.
+	chunkSize = 1024 * 1024
+
+	// Number of bytes and lines looked at to detect the log format.
+	detectionSampleSize  = 64 * 1024
+	detectionSampleLines = 20
 )
 
-func StartLogProcessingWorkflow(scanner *bufio.Scanner) <-chan string {
-	logEntriesChan := make(chan []string, logsChanSize)
-	processedLogsChan := make(chan string, processedLogsChanSize)
+// Limits bound the resources used by a workflow. A slow consumer of the
+// summaries slows the reading of the input down rather than letting batches
+// pile up.
+type Limits struct {
+	// Number of batches waiting for a worker, and of summaries waiting to be
+	// received. Defaults to DefaultQueueSize.
+	QueueSize int
+	// Number of bytes of log lines read but not yet summarized. Busy windows
+	// are read in parts of about 1 MiB, one of which is still read when the
+	// budget is smaller, and the whole input is read when merging windows.
+	// When a file is read in ranges, it bounds the bytes of the ranges read
+	// ahead instead. Defaults to DefaultMemoryBudget.
+	MemoryBudget int
+	// Number of goroutines counting windows, and of windows whose messages are
+	// ranked at once, or of ranges of a file read. Defaults to the number of
+	// CPUs.
+	Workers int
+}
+
+// workers returns the number of goroutines of a workflow.
+func (l Limits) workers() int {
+	if l.Workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return l.Workers
+}
+
+type Options struct {
+	Limits
+	// Number of most frequent messages reported per window. Defaults to 1.
+	Top int
+	// Length of the time ranges summarized. Defaults to one hour.
+	Window window.Window
+	// Time zone timestamps are converted to before they are grouped into
+	// windows and formatted. When nil, the offset of each line's timestamp is
+	// used.
+	Location *time.Location
+	// Merge lines of a window that are not contiguous in the input into a
+	// single summary. The whole input is read before the first summary is
+	// emitted.
+	Merge bool
+	// Parser of the log lines. When nil, the format is detected from the first
+	// lines of the input.
+	Parser processor.Parser
+	// Skip the first record of the input, which holds column names.
+	SkipHeader bool
+	// How messages differing only by their variable parts are grouped.
+	Templates processor.TemplateMode
+	// Length in bytes of the longest line read. Defaults to
+	// reader.DefaultMaxLineLength.
+	MaxLineLength int
+	// Cut lines longer than MaxLineLength instead of stopping the analysis.
+	Truncate bool
+	// When not nil, filled with the lines rejected by the parser. It is
+	// complete once the error channel has received, unless ctx was done, as
+	// the reader of a stream is not waited for then.
+	Report *processor.Report
+	// Number of rejected lines kept in the report.
+	Samples int
+	// Share of rejected lines, between 0 and 1, above which the analysis
+	// fails with reader.ErrTooManyRejected, as soon as reader.MinErrorRateLines
+	// lines are read. Ignored when 0.
+	MaxErrorRate float64
+}
+
+// StartLogProcessingWorkflow summarizes input in the background and returns the
+// channel the summaries are sent on, in input order. Once it is closed, the
+// second channel receives the error that ended reading early, such as a line
+// too long or ctx being done, or nil when the whole input was summarized. When
+// ctx is done, every stage stops.
+func StartLogProcessingWorkflow(ctx context.Context, input io.Reader, options Options) (<-chan processor.Summary, <-chan error) {
+	buffered := bufio.NewReaderSize(input, detectionSampleSize)
+	parser := options.Parser
+	if parser == nil {
+		parser = processor.DetectParser(sampleLines(buffered))
+	}
+	scanner := bufio.NewScanner(buffered)
+
+	queueSize := options.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	memoryBudget := options.MemoryBudget
+	if memoryBudget <= 0 {
+		memoryBudget = DefaultMemoryBudget
+	}
+
+	readChan := make(chan processor.Batch)
+	logEntriesChan := make(chan processor.Batch, queueSize)
+	resultsChan := make(chan processor.Result, maxBatchesInFlight)
+	windowsChan := make(chan processor.Result)
+	processedLogsChan := make(chan processor.Summary, queueSize)
+	inFlight := make(chan struct{}, maxBatchesInFlight)
+	held := newBudget(memoryBudget)
+	readErrChan := make(chan error, 1)
+	errChan := make(chan error, 1)
 
 	var wg sync.WaitGroup
 
-	workerCount := runtime.NumCPU()
+	summaryOptions := processor.Options{
+		Top:       options.Top,
+		Window:    options.Window,
+		Templates: options.Templates,
+	}
+	workerCount := options.workers()
 	for i := 0; i < workerCount; i++ {
 		wg.Add(1)
-		go processor.SummarizeLogFrequency(logEntriesChan, processedLogsChan, &wg)
+		go processor.SummarizeLogFrequency(ctx, logEntriesChan, resultsChan, summaryOptions, &wg)
 	}
 
 	go func() {
-		reader.ReadHourlyLogBatches(scanner, logEntriesChan)
-		close(logEntriesChan)
+		readErrChan <- reader.ReadLogBatches(ctx, scanner, readChan, reader.Options{
+			Parser:        parser,
+			Window:        options.Window,
+			Location:      options.Location,
+			Merge:         options.Merge,
+			SkipHeader:    options.SkipHeader,
+			MaxLineLength: options.MaxLineLength,
+			Truncate:      options.Truncate,
+			Report:        options.Report,
+			Samples:       options.Samples,
+			MaxErrorRate:  options.MaxErrorRate,
+			ChunkSize:     chunkSize,
+		})
+		close(readChan)
+	}()
+
+	go func() {
+		defer close(logEntriesChan)
+		for batch := range readChan {
+			// A slot is taken per window, by its first part
+			if batch.Part == 0 {
+				select {
+				case inFlight <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if !held.acquire(ctx, batch.Size) {
+				return
+			}
+			select {
+			case logEntriesChan <- batch:
+			case <-ctx.Done():
+				return
+			}
+		}
 	}()
 
 	go func() {
-		defer close(processedLogsChan)
+		defer close(resultsChan)
 		wg.Wait()
 	}()
 
-	return processedLogsChan
+	go func() {
+		defer close(windowsChan)
+		emitInOrder(ctx, resultsChan, windowsChan, inFlight, held)
+	}()
+
+	go func() {
+		summarizeInOrder(ctx, windowsChan, processedLogsChan, workerCount, summaryOptions)
+		close(processedLogsChan)
+		// The reader may still be blocked on the input once ctx is done
+		var err error
+		select {
+		case err = <-readErrChan:
+		case <-ctx.Done():
+		}
+		if err == nil {
+			// Batches read may have been dropped after reading ended
+			err = ctx.Err()
+		}
+		errChan <- err
+	}()
+
+	return processedLogsChan, errChan
+}
+
+// sampleLines returns the first complete lines of the input without consuming
+// them.
+func sampleLines(buffered *bufio.Reader) []string {
+	// Peek returns what could be read when the input is shorter than the sample
+	sample, err := buffered.Peek(detectionSampleSize)
+	lines := strings.Split(string(sample), "\n")
+	if err == nil {
+		// The last line may have been cut
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > detectionSampleLines {
+		lines = lines[:detectionSampleLines]
+	}
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	return lines
+}
+
+// emitInOrder merges the results of the parts of each window and forwards
+// complete windows sorted by sequence number, holding back those that are
+// complete before their predecessors. The bytes of every batch counted are
+// given back to held, and a slot of inFlight is released for every window
+// forwarded. It returns early once ctx is done.
+func emitInOrder(ctx context.Context, resultsChan <-chan processor.Result, windowsChan chan<- processor.Result, inFlight <-chan struct{}, held *budget) {
+	pending := make(map[int]*partialWindow)
+	next := 0
+	for result := range resultsChan {
+		held.release(result.Size)
+		window := pending[result.Seq]
+		if window == nil {
+			window = &partialWindow{parts: make(map[int]processor.Result)}
+			pending[result.Seq] = window
+		}
+		window.add(result)
+
+		for {
+			window, ok := pending[next]
+			if !ok || !window.complete() {
+				break
+			}
+			delete(pending, next)
+			select {
+			case windowsChan <- *window.merged:
+			case <-ctx.Done():
+				return
+			}
+			<-inFlight
+			next++
+		}
+	}
+}
+
+// summarizeInOrder sends the summaries of the windows received, in the same
+// order. Up to workers windows are summarized at once, so that ranking their
+// messages, and grouping them into drain templates, is done in parallel rather
+// than by a single goroutine. It returns early once ctx is done.
+func summarizeInOrder(ctx context.Context, windowsChan <-chan processor.Result, processedLogsChan chan<- processor.Summary, workers int, options processor.Options) {
+	// Summaries being computed, in window order
+	pending := make(chan chan processor.Summary, workers)
+	go func() {
+		defer close(pending)
+		for window := range windowsChan {
+			summary := make(chan processor.Summary, 1)
+			select {
+			case pending <- summary:
+			case <-ctx.Done():
+				return
+			}
+			go func() {
+				summary <- window.Summary(options)
+			}()
+		}
+	}()
+
+	for summary := range pending {
+		select {
+		case processedLogsChan <- <-summary:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// partialWindow gathers the results of the parts of a window.
+type partialWindow struct {
+	// Results of the consecutive parts received from the first one
+	merged *processor.Result
+	// Results received before their predecessors, by part
+	parts map[int]processor.Result
+}
+
+// add merges result, or holds it until the results of the parts before it
+// are received.
+func (w *partialWindow) add(result processor.Result) {
+	w.parts[result.Part] = result
+	for {
+		nextPart := 0
+		if w.merged != nil {
+			nextPart = w.merged.Part + 1
+		}
+		part, ok := w.parts[nextPart]
+		if !ok {
+			return
+		}
+		delete(w.parts, nextPart)
+		if w.merged == nil {
+			w.merged = &part
+		} else {
+			w.merged.Merge(part)
+		}
+	}
+}
+
+// complete reports whether the results of every part have been merged.
+func (w *partialWindow) complete() bool {
+	return w.merged != nil && w.merged.Last
 }
@@ -0,0 +1,395 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"loglizer/processor"
+	"loglizer/reader"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmitInOrder(t *testing.T) {
+	resultsChan := make(chan processor.Result, 10)
+	windowsChan := make(chan processor.Result, 5)
+	processedLogsChan := make(chan processor.Summary, 5)
+	inFlight := make(chan struct{}, 5)
+
+	result := func(seq, part int, last bool, messages ...string) processor.Result {
+		counts := processor.NewCounter(processor.NoTemplates)
+		for _, message := range messages {
+			counts.Add("app.go", message)
+		}
+		start := time.Date(2019, 4, 30, seq, 0, 0, 0, time.UTC)
+		return processor.Result{Seq: seq, Part: part, Last: last, Start: start, End: start.Add(time.Hour), Counts: counts}
+	}
+
+	// Results arrive in the order the workers finished, not the input order,
+	// and the second window is split into three parts
+	results := []processor.Result{
+		result(2, 0, true, "message"),
+		result(1, 2, true, "first", "first"),
+		result(0, 0, true, "message"),
+		result(4, 0, true, "message"),
+		result(1, 0, false, "first"),
+		result(3, 0, true, "message"),
+		result(1, 1, false, "second", "second"),
+	}
+	for _, result := range results {
+		if result.Part == 0 {
+			inFlight <- struct{}{}
+		}
+		resultsChan <- result
+	}
+	close(resultsChan)
+
+	emitInOrder(context.Background(), resultsChan, windowsChan, inFlight, newBudget(DefaultMemoryBudget))
+	close(windowsChan)
+	// Windows summarized in parallel are still sent in order
+	summarizeInOrder(context.Background(), windowsChan, processedLogsChan, 3, processor.Options{Top: 1})
+	close(processedLogsChan)
+
+	rows := collectRows(processedLogsChan)
+	for i, row := range rows {
+		want := fmt.Sprintf("04302019,%02d,1,1,1.0000,1,1,0,app.go,message,", i)
+		if i == 1 {
+			// The counts of the three parts are merged
+			want = "04302019,01,1,3,0.6000,5,2,0,app.go,first,"
+		}
+		if row != want {
+			t.Errorf("emitInOrder() row %d = %q, want %q", i, row, want)
+		}
+	}
+	if len(rows) != 5 {
+		t.Errorf("emitInOrder() emitted %d rows, want 5", len(rows))
+	}
+
+	if len(inFlight) != 0 {
+		t.Errorf("emitInOrder() left %d in-flight slots taken, want 0", len(inFlight))
+	}
+}
+
+func TestStartLogProcessingWorkflowIsOrdered(t *testing.T) {
+	var input strings.Builder
+	var expected []string
+	for day := 1; day <= 28; day++ {
+		for hour := 0; hour < 24; hour++ {
+			fmt.Fprintf(&input, "2019-04-%02dT%02d:15:00Z,app.go,message %d\n", day, hour, hour)
+			expected = append(expected, fmt.Sprintf("04%02d2019,%02d,1,1,1.0000,1,1,0,app.go,message %d,", day, hour, hour))
+		}
+	}
+
+	processedLogsChan, errChan := StartLogProcessingWorkflow(context.Background(), strings.NewReader(input.String()), Options{Top: 1})
+	rows := collectRows(processedLogsChan)
+	if err := <-errChan; err != nil {
+		t.Fatalf("StartLogProcessingWorkflow() failed: %v", err)
+	}
+
+	if len(rows) != len(expected) {
+		t.Fatalf("StartLogProcessingWorkflow() emitted %d rows, want %d", len(rows), len(expected))
+	}
+	for i := range expected {
+		if rows[i] != expected[i] {
+			t.Fatalf("row %d = %q, want %q", i, rows[i], expected[i])
+		}
+	}
+}
+
+func TestStartLogProcessingWorkflowNormalizesTimeZones(t *testing.T) {
+	input := `2019-04-30T12:01:39+02:00,network.go,Network connection established
+2019-04-30T10:02:03Z,network.go,Network connection established
+2019-04-30T12:59:49+02:00,db.go,Transaction failed
+`
+	expected := []string{"04302019,10,1,2,0.6667,3,2,0,network.go,Network connection established,"}
+
+	processedLogsChan, errChan := StartLogProcessingWorkflow(context.Background(), strings.NewReader(input), Options{Top: 1, Location: time.UTC})
+	rows := collectRows(processedLogsChan)
+	if err := <-errChan; err != nil {
+		t.Fatalf("StartLogProcessingWorkflow() failed: %v", err)
+	}
+
+	if strings.Join(rows, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("StartLogProcessingWorkflow() emitted %q, want %q", rows, expected)
+	}
+}
+
+func TestStartLogProcessingWorkflowDetectsFormat(t *testing.T) {
+	input := `{"time":"2019-04-30T12:01:39+02:00","file":"network.go","msg":"Network connection established"}
+{"time":"2019-04-30T12:01:42+02:00","file":"db.go","msg":"Transaction failed"}
+{"time":"2019-04-30T12:02:03+02:00","file":"db.go","msg":"Transaction failed"}`
+	expected := []string{"04302019,12,1,2,0.6667,3,2,0,db.go,Transaction failed,"}
+
+	processedLogsChan, errChan := StartLogProcessingWorkflow(context.Background(), strings.NewReader(input), Options{Top: 1})
+	rows := collectRows(processedLogsChan)
+	if err := <-errChan; err != nil {
+		t.Fatalf("StartLogProcessingWorkflow() failed: %v", err)
+	}
+
+	if strings.Join(rows, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("StartLogProcessingWorkflow() emitted %q, want %q", rows, expected)
+	}
+}
+
+func TestStartLogProcessingWorkflowStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	processedLogsChan, errChan := StartLogProcessingWorkflow(ctx, &endlessLog{}, Options{Top: 1})
+
+	<-processedLogsChan
+	cancel()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-processedLogsChan:
+			if !ok {
+				if err := <-errChan; !errors.Is(err, context.Canceled) {
+					t.Errorf("StartLogProcessingWorkflow() failed with %v, want %v", err, context.Canceled)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("StartLogProcessingWorkflow() did not close its channel after cancellation")
+		}
+	}
+}
+
+func TestStartLogProcessingWorkflowReportsLongLines(t *testing.T) {
+	input := "2019-04-30T12:01:39+02:00,network.go,Network connection established\n" +
+		"2019-04-30T13:01:42+02:00,db.go," + strings.Repeat("x", 100) + "\n" +
+		"2019-04-30T14:02:03+02:00,tardis.go,TARDIS dematerializing\n"
+
+	processedLogsChan, errChan := StartLogProcessingWorkflow(context.Background(), strings.NewReader(input), Options{Top: 1, MaxLineLength: 80})
+	rows := collectRows(processedLogsChan)
+
+	// The window read before the long line is still summarized
+	expected := []string{"04302019,12,1,1,1.0000,1,1,0,network.go,Network connection established,"}
+	if strings.Join(rows, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("StartLogProcessingWorkflow() emitted %q, want %q", rows, expected)
+	}
+	if err := <-errChan; !errors.Is(err, reader.ErrLineTooLong) {
+		t.Errorf("StartLogProcessingWorkflow() failed with %v, want %v", err, reader.ErrLineTooLong)
+	}
+}
+
+func TestStartLogProcessingWorkflowWithinLimits(t *testing.T) {
+	var input strings.Builder
+	for hour := 0; hour < 24; hour++ {
+		fmt.Fprintf(&input, "2019-04-30T%02d:01:39Z,app.go,message\n", hour)
+	}
+
+	// Every batch is larger than the whole budget
+	processedLogsChan, errChan := StartLogProcessingWorkflow(context.Background(), strings.NewReader(input.String()), Options{
+		Limits: Limits{QueueSize: 1, MemoryBudget: 10},
+		Top:    1,
+	})
+	rows := collectRows(processedLogsChan)
+	if err := <-errChan; err != nil {
+		t.Fatalf("StartLogProcessingWorkflow() failed: %v", err)
+	}
+	if len(rows) != 24 {
+		t.Errorf("StartLogProcessingWorkflow() emitted %d rows, want 24", len(rows))
+	}
+}
+
+func TestSummarizeRangesMatchesStream(t *testing.T) {
+	var input strings.Builder
+	input.WriteString("timestamp,file,message\n")
+	for i := 0; i < 200; i++ {
+		// Hours go back and forth, with a rejected line now and then
+		fmt.Fprintf(&input, "2019-04-30T%02d:%02d:00Z,service%d.go,Request %d failed\n", i/30%4+i/90, i%60, i%3, i%7)
+		if i%37 == 0 {
+			input.WriteString("not a log line\n")
+		}
+	}
+	input.WriteString("2019-04-30T09:01:00Z,db.go,\"Transaction failed\nrolling back\"\n")
+	data := input.String()
+
+	tests := map[string]Options{
+		"contiguous": {Top: 3, SkipHeader: true},
+		"merged":     {Top: 3, SkipHeader: true, Merge: true},
+		"drain":      {Top: 3, SkipHeader: true, Templates: processor.DrainTemplates},
+		"long line":  {Top: 3, SkipHeader: true, MaxLineLength: 50},
+	}
+	for name, options := range tests {
+		t.Run(name, func(t *testing.T) {
+			options.Samples = 5
+			options.Report = &processor.Report{}
+			processedLogsChan, errChan := StartLogProcessingWorkflow(context.Background(), strings.NewReader(data), options)
+			expected := collectRows(processedLogsChan)
+			expectedErr := fmt.Sprint(<-errChan)
+			expectedReport := *options.Report
+
+			// Ranges are read in parallel even on a single CPU
+			options.Workers = 3
+			for n := 1; n <= 6; n++ {
+				options.Report = &processor.Report{}
+				processedLogsChan, errChan := summarizeRanges(context.Background(), strings.NewReader(data), int64(len(data)), n, options)
+				rows := collectRows(processedLogsChan)
+				if err := fmt.Sprint(<-errChan); err != expectedErr {
+					t.Errorf("%d ranges: failed with %s, want %s", n, err, expectedErr)
+				}
+				if strings.Join(rows, "\n") != strings.Join(expected, "\n") {
+					t.Errorf("%d ranges: emitted %q, want %q", n, rows, expected)
+				}
+				if !reflect.DeepEqual(*options.Report, expectedReport) {
+					t.Errorf("%d ranges: report %+v, want %+v", n, *options.Report, expectedReport)
+				}
+			}
+		})
+	}
+}
+
+func TestSummarizeRangesStreams(t *testing.T) {
+	var input strings.Builder
+	for hour := 0; hour < 8; hour++ {
+		for i := 0; i < 100; i++ {
+			fmt.Fprintf(&input, "2019-04-30T%02d:%02d:00Z,app.go,message %d\n", hour, i%60, hour)
+		}
+	}
+	data := input.String()
+
+	csv, _ := processor.ParserFor("csv")
+	offsets, err := reader.SplitRanges(strings.NewReader(data), int64(len(data)), 8, csv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The last range cannot be read until a summary is received
+	release := make(chan struct{})
+	file := &gatedReaderAt{ReaderAt: strings.NewReader(data), offset: offsets[len(offsets)-2], release: release}
+	processedLogsChan, errChan := summarizeRanges(context.Background(), file, int64(len(data)), 8, Options{Top: 1, Parser: csv, Limits: Limits{Workers: 2}})
+	select {
+	case <-processedLogsChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no summary was sent before the whole file was read")
+	}
+	close(release)
+
+	rows := collectRows(processedLogsChan)
+	if len(rows) != 7 {
+		t.Errorf("got %d more summaries, want 7", len(rows))
+	}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// gatedReaderAt blocks reading at offset until release is closed.
+type gatedReaderAt struct {
+	io.ReaderAt
+	offset  int64
+	release <-chan struct{}
+}
+
+func (r *gatedReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	if offset == r.offset {
+		<-r.release
+	}
+	return r.ReaderAt.ReadAt(p, offset)
+}
+
+func TestBudget(t *testing.T) {
+	ctx := context.Background()
+	held := newBudget(100)
+	if !held.acquire(ctx, 60) {
+		t.Fatal("acquire(60) failed on an empty budget")
+	}
+
+	acquired := make(chan bool)
+	go func() {
+		// More than the budget: waits for it to be empty
+		acquired <- held.acquire(ctx, 500)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquire(500) did not wait for the budget to be released")
+	case <-time.After(10 * time.Millisecond):
+	}
+	held.release(60)
+	if !<-acquired {
+		t.Fatal("acquire(500) failed once the budget was released")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if held.acquire(cancelled, 1) {
+		t.Error("acquire(1) succeeded on a full budget")
+	}
+}
+
+// endlessLog is an input that never ends, with one line per minute.
+type endlessLog struct {
+	pending []byte
+	minutes int
+}
+
+func (l *endlessLog) Read(p []byte) (int, error) {
+	if len(l.pending) == 0 {
+		timestamp := time.Date(2019, 4, 30, 0, l.minutes, 0, 0, time.UTC)
+		l.pending = []byte(timestamp.Format(time.RFC3339) + ",app.go,message\n")
+		l.minutes++
+	}
+	n := copy(p, l.pending)
+	l.pending = l.pending[n:]
+	return n, nil
+}
+
+// collectRows reads all summaries and joins the fields of their records with
+// commas.
+func collectRows(summaries <-chan processor.Summary) []string {
+	var rows []string
+	for summary := range summaries {
+		for _, record := range summary.Records() {
+			rows = append(rows, strings.Join(record, ","))
+		}
+	}
+	return rows
+}
+
+func BenchmarkStartLogProcessingWorkflow(b *testing.B) {
+	// A day, or a single busy hour, of logs with a few hundred distinct
+	// messages
+	for _, hours := range []int{24, 1} {
+		var input strings.Builder
+		for i := 0; i < 500000; i++ {
+			fmt.Fprintf(&input, "2019-04-30T%02d:%02d:%02dZ,service%d.go,Request %d failed after %dms\n", i*hours/500000, i/348%60, i%60, i%7, i%53, i%300)
+		}
+		data := input.String()
+
+		b.Run(fmt.Sprintf("hours=%d", hours), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				processedLogsChan, errChan := StartLogProcessingWorkflow(context.Background(), strings.NewReader(data), Options{Top: 10})
+				for range processedLogsChan {
+				}
+				if err := <-errChan; err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkStartFileProcessingWorkflow(b *testing.B) {
+	var input strings.Builder
+	for i := 0; i < 500000; i++ {
+		fmt.Fprintf(&input, "2019-04-30T%02d:%02d:%02dZ,service%d.go,Request %d failed after %dms\n", i*24/500000, i/348%60, i%60, i%7, i%53, i%300)
+	}
+	data := input.String()
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		processedLogsChan, errChan := StartFileProcessingWorkflow(context.Background(), strings.NewReader(data), int64(len(data)), Options{Top: 10})
+		for range processedLogsChan {
+		}
+		if err := <-errChan; err != nil {
+			b.Fatal(err)
+		}
+	}
+}
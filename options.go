@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"loglizer/combiner"
+	"loglizer/manager"
+	"loglizer/processor"
+	"loglizer/window"
+	"math"
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// parseOptions reads the analysis and output options from the query
+// parameters of a request.
+func parseOptions(query url.Values) (manager.Options, combiner.Options, error) {
+	options := manager.Options{Top: 1, Samples: defaultSamples}
+	outputOptions := combiner.Options{Format: combiner.CSV, Comma: ','}
+
+	if top := query.Get("top"); top != "" {
+		n, err := strconv.Atoi(top)
+		if err != nil || n < 1 {
+			return options, outputOptions, fmt.Errorf("invalid top: must be a positive integer")
+		}
+		options.Top = n
+	}
+	if size := query.Get("window"); size != "" {
+		win, err := window.Parse(size)
+		if err != nil {
+			return options, outputOptions, fmt.Errorf("invalid window: must be day, week or a duration such as 5m")
+		}
+		options.Window = win
+	}
+	if tz := query.Get("tz"); tz != "" {
+		location, err := time.LoadLocation(tz)
+		if err != nil {
+			return options, outputOptions, fmt.Errorf("invalid tz: must be a time zone name such as UTC or Europe/Paris")
+		}
+		options.Location = location
+	}
+	if templates := query.Get("templates"); templates != "" {
+		mode, err := processor.ParseTemplateMode(templates)
+		if err != nil {
+			return options, outputOptions, fmt.Errorf("invalid templates: %w", err)
+		}
+		options.Templates = mode
+	}
+	if maxLine := query.Get("maxline"); maxLine != "" {
+		n, err := strconv.Atoi(maxLine)
+		if err != nil || n < 1 {
+			return options, outputOptions, fmt.Errorf("invalid maxline: must be a positive integer")
+		}
+		options.MaxLineLength = n
+	}
+	if samples := query.Get("samples"); samples != "" {
+		n, err := strconv.Atoi(samples)
+		if err != nil || n < 0 {
+			return options, outputOptions, fmt.Errorf("invalid samples: must be a non-negative integer")
+		}
+		options.Samples = n
+	}
+	if rate := query.Get("maxerrorrate"); rate != "" {
+		f, err := strconv.ParseFloat(rate, 64)
+		if err != nil || f < 0 || f > 1 {
+			return options, outputOptions, fmt.Errorf("invalid maxerrorrate: must be a number between 0 and 1")
+		}
+		options.MaxErrorRate = f
+	}
+	if delimiter := query.Get("delimiter"); delimiter != "" {
+		comma, err := parseDelimiter(delimiter)
+		if err != nil {
+			return options, outputOptions, err
+		}
+		outputOptions.Comma = comma
+	}
+
+	switch format := query.Get("format"); format {
+	case "", "auto":
+		// A delimiter is only meaningful for CSV input
+		if query.Has("delimiter") {
+			options.Parser = processor.NewCSVParser(outputOptions.Comma)
+		}
+	case "csv":
+		options.Parser = processor.NewCSVParser(outputOptions.Comma)
+	default:
+		parser, err := processor.ParserFor(format)
+		if err != nil {
+			return options, outputOptions, fmt.Errorf("invalid format: %w", err)
+		}
+		options.Parser = parser
+	}
+
+	var report bool
+	flags := []struct {
+		name  string
+		value *bool
+	}{
+		{"report", &report},
+		{"merge", &options.Merge},
+		{"skipheader", &options.SkipHeader},
+		{"truncate", &options.Truncate},
+		{"header", &outputOptions.Header},
+	}
+	for _, flag := range flags {
+		value := query.Get(flag.name)
+		if value == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, outputOptions, fmt.Errorf("invalid %s: must be a boolean", flag.name)
+		}
+		*flag.value = b
+	}
+	if report {
+		options.Report = &processor.Report{}
+	}
+
+	return options, outputOptions, nil
+}
+
+// parseCache reads the query parameters deciding whether the known summaries
+// of an upload are reused: sha256 gives the SHA-256 of the file, in
+// hexadecimal, so that they are found before it is read, and force asks for
+// the file to be analyzed again.
+func parseCache(query url.Values) (hash string, force bool, err error) {
+	hash = strings.ToLower(query.Get("sha256"))
+	if hash != "" {
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha256.Size {
+			return "", false, fmt.Errorf("invalid sha256: must be 64 hexadecimal digits")
+		}
+	}
+	if value := query.Get("force"); value != "" {
+		if force, err = strconv.ParseBool(value); err != nil {
+			return "", false, fmt.Errorf("invalid force: must be a boolean")
+		}
+	}
+	return hash, force, nil
+}
+
+// analysisQuery returns the query parameters of an analysis in canonical form,
+// leaving out those that do not change its summaries. Uploads of the same
+// content analyzed with the same query have the same summaries.
+func analysisQuery(query url.Values) string {
+	canonical := make(url.Values, len(query))
+	for name, values := range query {
+		if name != "sha256" && name != "force" {
+			canonical[name] = values
+		}
+	}
+	// Sorted by name
+	return canonical.Encode()
+}
+
+// Number of rejected lines listed in a report by default.
+const defaultSamples = 10
+
+// errReportFormat is returned when a report is asked for with CSV output.
+var errReportFormat = errors.New("a report requires JSON or NDJSON output")
+
+// limitFlags defines the flags setting the limits of the workflows run by a
+// command.
+func limitFlags(flags *flag.FlagSet) *manager.Limits {
+	limits := &manager.Limits{
+		QueueSize:    manager.DefaultQueueSize,
+		MemoryBudget: manager.DefaultMemoryBudget,
+	}
+	flags.IntVar(&limits.QueueSize, "queue", limits.QueueSize, "number of windows queued between the stages of an analysis")
+	flags.Var((*byteSize)(&limits.MemoryBudget), "memory", "log lines held in memory per analysis, such as 64MiB or 1GB")
+	flags.IntVar(&limits.Workers, "workers", 0, "number of goroutines counting the windows of an analysis, 0 for one per CPU")
+	return limits
+}
+
+// checkLimits validates the limits set by the flags of limitFlags.
+func checkLimits(limits manager.Limits) error {
+	if limits.QueueSize < 1 {
+		return fmt.Errorf("invalid queue: must be a positive integer")
+	}
+	if limits.Workers < 0 {
+		return fmt.Errorf("invalid workers: must be a non-negative integer")
+	}
+	return nil
+}
+
+// byteSize is a number of bytes written with an optional unit, such as 512KiB
+// or 1GB.
+type byteSize int
+
+var byteUnits = []struct {
+	suffix string
+	size   int
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30},
+	{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9},
+	{"k", 1 << 10}, {"m", 1 << 20}, {"g", 1 << 30},
+	{"b", 1},
+}
+
+func (s *byteSize) String() string {
+	if *s != 0 && *s%(1<<20) == 0 {
+		return strconv.Itoa(int(*s>>20)) + "MiB"
+	}
+	return strconv.Itoa(int(*s))
+}
+
+func (s *byteSize) Set(value string) error {
+	value = strings.ToLower(strings.TrimSpace(value))
+	multiplier := 1
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > math.MaxInt/multiplier {
+		return fmt.Errorf("must be a positive number of bytes, such as 512KiB or 1GB")
+	}
+	*s = byteSize(n * multiplier)
+	return nil
+}
+
+// parseDelimiter reads a CSV delimiter, given as a single character or as
+// "tab".
+func parseDelimiter(delimiter string) (rune, error) {
+	if delimiter == "tab" || delimiter == `\t` {
+		return '\t', nil
+	}
+	comma, size := utf8.DecodeRuneInString(delimiter)
+	if size != len(delimiter) || comma == utf8.RuneError || comma == '"' || comma == '\r' || comma == '\n' {
+		return 0, fmt.Errorf("invalid delimiter: must be a single character other than a quote or line break")
+	}
+	return comma, nil
+}
+
+var mediaTypes = map[string]combiner.Format{
+	"text/csv":             combiner.CSV,
+	"text/*":               combiner.CSV,
+	"*/*":                  combiner.CSV,
+	"application/json":     combiner.JSON,
+	"application/x-ndjson": combiner.NDJSON,
+	"application/ndjson":   combiner.NDJSON,
+}
+
+// negotiateFormat picks the output format preferred by an Accept header,
+// following the q values of its media ranges. CSV is used when the header is
+// empty.
+func negotiateFormat(accept string) (combiner.Format, error) {
+	if strings.TrimSpace(accept) == "" {
+		return combiner.CSV, nil
+	}
+
+	format := combiner.CSV
+	bestQuality := 0.0
+	bestIsWildcard := false
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+		candidate, ok := mediaTypes[mediaType]
+		if !ok {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		// The first type listed wins among those of the same quality, except
+		// that exact types win over wildcards
+		isWildcard := strings.Contains(mediaType, "*")
+		if quality > bestQuality || quality == bestQuality && quality > 0 && bestIsWildcard && !isWildcard {
+			format = candidate
+			bestQuality = quality
+			bestIsWildcard = isWildcard
+		}
+	}
+	if bestQuality == 0 {
+		return format, fmt.Errorf("not acceptable: supported types are text/csv, application/json and application/x-ndjson")
+	}
+	return format, nil
+}
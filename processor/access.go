@@ -0,0 +1,36 @@
+package processor
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// HOST IDENT USER [TIME] "REQUEST" STATUS SIZE ["REFERER" "USER-AGENT"]
+var combinedPattern = regexp.MustCompile(`^\S+ \S+ \S+ \[([^\]]+)\] "((?:[^"\\]|\\.)*)" (\d{3}) \S+`)
+
+// combinedParser reads the Apache and Nginx common and combined access log
+// formats. The status code is used as the file, and the message is the
+// request method and path without query string, so that requests to the same
+// endpoint are counted together.
+type combinedParser struct{}
+
+func (combinedParser) Parse(line string) (LogEntry, error) {
+	match := combinedPattern.FindStringSubmatch(line)
+	if match == nil {
+		return LogEntry{}, fmt.Errorf("invalid access log entry: %s", line)
+	}
+	timestamp, err := time.Parse("02/Jan/2006:15:04:05 -0700", match[1])
+	if err != nil {
+		return LogEntry{}, fmt.Errorf("invalid access log entry: %w: %w", ErrInvalidTimestamp, err)
+	}
+
+	message := match[2]
+	if parts := strings.Fields(message); len(parts) >= 2 {
+		path, _, _ := strings.Cut(parts[1], "?")
+		message = parts[0] + " " + path
+	}
+
+	return LogEntry{Timestamp: timestamp, File: match[3], Message: message}, nil
+}
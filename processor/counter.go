@@ -0,0 +1,175 @@
+package processor
+
+import (
+	"sort"
+	"strings"
+)
+
+// Number of distinct messages whose masked form a Counter keeps, in the mask
+// mode, so that masking a message seen again is not repeated. The cache is
+// emptied once full, so it does not grow with the number of raw messages.
+const maxMaskCache = 4096
+
+// Counter counts the entries of one window as they are parsed, by file and
+// message grouped according to its template mode. Keys are copied when first
+// seen, so the lines they were read from are not held, and counting an entry
+// already seen allocates nothing.
+//
+// Counters of consecutive parts of a window can be merged, giving the same
+// result as counting the whole window at once. A Counter is not safe for
+// concurrent use.
+type Counter struct {
+	mode    TemplateMode
+	indexes map[counterKey]int
+	// Counts in first-seen order, with the key of each
+	counts []LogCount
+	keys   []counterKey
+	total  int
+	// Masked messages by raw message, in the mask mode, at most maxMaskCache
+	masks map[string]string
+}
+
+// counterKey identifies a count. Drain templates depend on every message of
+// the window, so in the drain mode messages are counted as they are and only
+// grouped by Top.
+type counterKey struct {
+	file    string
+	message string
+}
+
+// NewCounter returns an empty counter grouping messages according to mode.
+func NewCounter(mode TemplateMode) *Counter {
+	c := &Counter{mode: mode, indexes: make(map[counterKey]int)}
+	if mode == MaskTemplates {
+		c.masks = make(map[string]string)
+	}
+	return c
+}
+
+// Add counts one entry.
+func (c *Counter) Add(file, message string) {
+	k := counterKey{file: file, message: message}
+	if c.mode == MaskTemplates {
+		masked, ok := c.masks[message]
+		if !ok {
+			if len(c.masks) >= maxMaskCache {
+				clear(c.masks)
+			}
+			masked = strings.Clone(maskMessage(message))
+			c.masks[strings.Clone(message)] = masked
+		}
+		k.message = masked
+	}
+
+	c.total++
+	if i, ok := c.indexes[k]; ok {
+		c.counts[i].Count++
+		return
+	}
+	file, message = strings.Clone(file), strings.Clone(message)
+	k.file = file
+	if c.mode != MaskTemplates {
+		k.message = message
+	}
+	c.insert(k, LogCount{File: file, Message: message, Count: 1})
+}
+
+func (c *Counter) insert(k counterKey, count LogCount) {
+	c.indexes[k] = len(c.counts)
+	c.counts = append(c.counts, count)
+	c.keys = append(c.keys, k)
+}
+
+// Merge adds the counts of other, which counted the part of the window that
+// follows the one counted by c. Both must use the same template mode.
+func (c *Counter) Merge(other *Counter) {
+	c.total += other.total
+	for i, k := range other.keys {
+		if j, ok := c.indexes[k]; ok {
+			c.counts[j].Count += other.counts[i].Count
+			continue
+		}
+		c.insert(k, other.counts[i])
+	}
+}
+
+// Total returns the number of entries counted.
+func (c *Counter) Total() int {
+	return c.total
+}
+
+// Top returns the n most frequent pairs counted and the number of distinct
+// pairs. They are ordered by count, highest first; pairs with the same count
+// keep the order in which they first appeared.
+func (c *Counter) Top(n int) ([]LogCount, int) {
+	if c.total == 0 {
+		return nil, 0
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	var counts []LogCount
+	switch c.mode {
+	case MaskTemplates:
+		counts = make([]LogCount, len(c.counts))
+		copy(counts, c.counts)
+		for i := range counts {
+			counts[i].Template = c.keys[i].message
+		}
+	case DrainTemplates:
+		counts = c.groupByDrain()
+	default:
+		counts = make([]LogCount, len(c.counts))
+		copy(counts, c.counts)
+	}
+	distinct := len(counts)
+
+	// counts is in first-seen order, which a stable sort preserves for ties
+	sort.SliceStable(counts, func(i, j int) bool {
+		return counts[i].Count > counts[j].Count
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	for i := range counts {
+		counts[i].Share = float64(counts[i].Count) / float64(c.total)
+	}
+
+	return counts, distinct
+}
+
+// groupByDrain adds the messages counted to a drain in the order they first
+// appeared, and sums the counts of each file and cluster. A message always
+// counts toward the cluster it first joined.
+func (c *Counter) groupByDrain() []LogCount {
+	type key struct {
+		file    string
+		cluster *drainCluster
+	}
+	miner := newDrain()
+	clusters := make(map[string]*drainCluster)
+	indexes := make(map[key]int)
+	var counts []LogCount
+	var countClusters []*drainCluster
+	for _, count := range c.counts {
+		cluster, ok := clusters[count.Message]
+		if !ok {
+			cluster = miner.add(count.Message)
+			clusters[count.Message] = cluster
+		}
+		k := key{file: count.File, cluster: cluster}
+		if i, ok := indexes[k]; ok {
+			counts[i].Count += count.Count
+			continue
+		}
+		indexes[k] = len(counts)
+		counts = append(counts, count)
+		countClusters = append(countClusters, cluster)
+	}
+	// Templates are only final once every message has been added
+	for i := range counts {
+		counts[i].Template = countClusters[i].template()
+	}
+	return counts
+}
@@ -0,0 +1,27 @@
+package processor
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Date and time written by Go's log package with the LstdFlags flag, with
+// optional microseconds and file name.
+var goLogPattern = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?) (?:(\S+\.go:\d+): )?(.*)$`)
+
+// goLogParser reads lines written by Go's standard log package. Its
+// timestamps have no time zone and are read as UTC.
+type goLogParser struct{}
+
+func (goLogParser) Parse(line string) (LogEntry, error) {
+	match := goLogPattern.FindStringSubmatch(line)
+	if match == nil {
+		return LogEntry{}, fmt.Errorf("invalid Go log entry: %s", line)
+	}
+	timestamp, err := time.Parse("2006/01/02 15:04:05.999999999", match[1])
+	if err != nil {
+		return LogEntry{}, fmt.Errorf("invalid Go log entry: %w: %w", ErrInvalidTimestamp, err)
+	}
+	return LogEntry{Timestamp: timestamp, File: match[2], Message: match[3]}, nil
+}
@@ -0,0 +1,157 @@
+package processor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Parser turns one line of a log file into a LogEntry.
+type Parser interface {
+	Parse(line string) (LogEntry, error)
+}
+
+// Errors wrapped by parsers to tell why a line was rejected.
+var (
+	ErrMissingTimestamp = errors.New("missing timestamp")
+	ErrInvalidTimestamp = errors.New("invalid timestamp")
+	ErrMissingMessage   = errors.New("missing message")
+)
+
+// RejectionReason classifies an error returned by a parser: the message of
+// the error above it wraps, or "malformed" for lines that do not follow the
+// format at all.
+func RejectionReason(err error) string {
+	for _, reason := range []error{ErrMissingTimestamp, ErrInvalidTimestamp, ErrMissingMessage} {
+		if errors.Is(err, reason) {
+			return reason.Error()
+		}
+	}
+	return "malformed"
+}
+
+var parsers = map[string]Parser{
+	"csv":      NewCSVParser(','),
+	"json":     jsonParser{},
+	"logfmt":   logfmtParser{},
+	"syslog":   syslogParser{},
+	"combined": combinedParser{},
+	"golog":    goLogParser{},
+}
+
+// Order in which parsers are tried when detecting the format of a file. The
+// first one parsing the most sample lines wins.
+var detectionOrder = []string{"csv", "json", "logfmt", "syslog", "combined", "golog"}
+
+// ParserFor returns the parser registered under name, such as "csv" or "json".
+func ParserFor(name string) (Parser, error) {
+	parser, ok := parsers[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown log format %q, expected one of %s", name, strings.Join(ParserNames(), ", "))
+	}
+	return parser, nil
+}
+
+// ParserNames lists the names accepted by ParserFor.
+func ParserNames() []string {
+	names := make([]string, 0, len(parsers))
+	for name := range parsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DetectParser picks the parser that understands the most of the sample
+// lines. Empty lines are ignored. It falls back to the CSV parser when no
+// parser understands any of them.
+func DetectParser(lines []string) Parser {
+	best := parsers["csv"]
+	bestCount := 0
+	for _, name := range detectionOrder {
+		count := 0
+		for _, line := range lines {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if _, err := parsers[name].Parse(line); err == nil {
+				count++
+			}
+		}
+		if count > bestCount {
+			best = parsers[name]
+			bestCount = count
+		}
+	}
+	return best
+}
+
+// RecordSplitter is implemented by parsers whose records may span several
+// lines. Split is used as the bufio.SplitFunc of the input instead of
+// bufio.ScanLines.
+type RecordSplitter interface {
+	Split(data []byte, atEOF bool) (int, []byte, error)
+}
+
+// csvParser reads the "RFC3339 timestamp,file,message" format. Fields can be
+// quoted as in RFC 4180, so a quoted message may contain the delimiter, quotes
+// and line breaks.
+type csvParser struct {
+	comma rune
+}
+
+// NewCSVParser returns a parser of "timestamp,file,message" records separated
+// by comma instead of ','.
+func NewCSVParser(comma rune) Parser {
+	return csvParser{comma: comma}
+}
+
+func (p csvParser) Parse(line string) (LogEntry, error) {
+	return parseLog(line, p.comma)
+}
+
+// Split returns one record at a time, ignoring line breaks inside quoted
+// fields. Like bufio.ScanLines, it drops the trailing line break and carriage
+// return.
+func (p csvParser) Split(data []byte, atEOF bool) (int, []byte, error) {
+	comma := []byte(string(p.comma))
+	fieldStart := true
+	quoted := false
+	for i := 0; i < len(data); i++ {
+		switch {
+		case quoted:
+			if data[i] != '"' {
+				continue
+			}
+			if i+1 == len(data) && !atEOF {
+				// An escaped quote may continue in the next read
+				return 0, nil, nil
+			}
+			if i+1 < len(data) && data[i+1] == '"' {
+				i++
+				continue
+			}
+			quoted = false
+		case data[i] == '\n':
+			return i + 1, dropCR(data[:i]), nil
+		case fieldStart && data[i] == '"':
+			quoted = true
+			fieldStart = false
+		case bytes.HasPrefix(data[i:], comma):
+			i += len(comma) - 1
+			fieldStart = true
+		default:
+			fieldStart = false
+		}
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), dropCR(data), nil
+	}
+	return 0, nil, nil
+}
+
+func dropCR(data []byte) []byte {
+	return bytes.TrimSuffix(data, []byte{'\r'})
+}
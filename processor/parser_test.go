@@ -0,0 +1,258 @@
+package processor
+
+import (
+	"bufio"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsers(t *testing.T) {
+	tests := []struct {
+		format   string
+		line     string
+		expected LogEntry
+	}{
+		{
+			format:   "csv",
+			line:     "2019-04-30T12:01:39+02:00,network.go,Network connection established",
+			expected: LogEntry{mustParse("2019-04-30T12:01:39+02:00"), "network.go", "Network connection established"},
+		},
+		{
+			format:   "json",
+			line:     `{"time":"2019-04-30T12:01:39.5+02:00","level":"info","caller":"network.go:42","msg":"Network connection established"}`,
+			expected: LogEntry{mustParse("2019-04-30T12:01:39.5+02:00"), "network.go:42", "Network connection established"},
+		},
+		{
+			format:   "json",
+			line:     `{"ts":1556618499.5,"logger":"network","message":"Network connection established"}`,
+			expected: LogEntry{mustParse("2019-04-30T10:01:39.5Z"), "network", "Network connection established"},
+		},
+		{
+			format:   "logfmt",
+			line:     `time=2019-04-30T12:01:39+02:00 level=error file=db.go msg="Transaction \"42\" failed" retry`,
+			expected: LogEntry{mustParse("2019-04-30T12:01:39+02:00"), "db.go", `Transaction "42" failed`},
+		},
+		{
+			format:   "syslog",
+			line:     `<165>1 2019-04-30T10:01:39.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="App\"lication\]"] An application event`,
+			expected: LogEntry{mustParse("2019-04-30T10:01:39.003Z"), "evntslog", "An application event"},
+		},
+		{
+			format:   "syslog",
+			line:     `<34>1 2019-04-30T12:01:39+02:00 mymachine su - ID47 - 'su root' failed for lonvick on /dev/pts/8`,
+			expected: LogEntry{mustParse("2019-04-30T12:01:39+02:00"), "su", "'su root' failed for lonvick on /dev/pts/8"},
+		},
+		{
+			format:   "combined",
+			line:     `127.0.0.1 - frank [30/Apr/2019:12:01:39 +0200] "GET /apache_pb.gif?size=2 HTTP/1.0" 404 2326 "http://www.example.com/start.html" "Mozilla/4.08"`,
+			expected: LogEntry{mustParse("2019-04-30T12:01:39+02:00"), "404", "GET /apache_pb.gif"},
+		},
+		{
+			format:   "combined",
+			line:     `127.0.0.1 - - [30/Apr/2019:12:01:39 +0200] "-" 400 0`,
+			expected: LogEntry{mustParse("2019-04-30T12:01:39+02:00"), "400", "-"},
+		},
+		{
+			format:   "golog",
+			line:     `2019/04/30 10:01:39.123456 network.go:42: Network connection established`,
+			expected: LogEntry{mustParse("2019-04-30T10:01:39.123456Z"), "network.go:42", "Network connection established"},
+		},
+		{
+			format:   "golog",
+			line:     `2019/04/30 10:01:39 Server starting on port 15442...`,
+			expected: LogEntry{mustParse("2019-04-30T10:01:39Z"), "", "Server starting on port 15442..."},
+		},
+	}
+
+	for _, test := range tests {
+		parser, err := ParserFor(test.format)
+		if err != nil {
+			t.Fatalf("ParserFor(%q) returned an error: %v", test.format, err)
+		}
+		result, err := parser.Parse(test.line)
+		if err != nil {
+			t.Errorf("%s parser returned an error for %q: %v", test.format, test.line, err)
+			continue
+		}
+		if !result.Timestamp.Equal(test.expected.Timestamp) || result.File != test.expected.File || result.Message != test.expected.Message {
+			t.Errorf("%s parser: expected %+v, got %+v", test.format, test.expected, result)
+		}
+	}
+}
+
+func TestParseLogQuoting(t *testing.T) {
+	tests := map[string]LogEntry{
+		// Unquoted delimiters after the file belong to the message
+		`2019-04-30T12:01:39+02:00,db.go,Transaction failed, rolling back`:     {File: "db.go", Message: "Transaction failed, rolling back"},
+		`2019-04-30T12:01:39+02:00,"db,v2.go","Query ""users"" failed"`:        {File: "db,v2.go", Message: `Query "users" failed`},
+		"2019-04-30T12:01:39+02:00,db.go,\"Transaction failed\nrolling back\"": {File: "db.go", Message: "Transaction failed\nrolling back"},
+		`2019-04-30T12:01:39+02:00,hal9000.go,I'm sorry "Dave"`:                {File: "hal9000.go", Message: `I'm sorry "Dave"`},
+	}
+
+	for line, expected := range tests {
+		result, err := parseLog(line, ',')
+		if err != nil {
+			t.Errorf("parseLog(%q) returned an error: %v", line, err)
+			continue
+		}
+		if result.File != expected.File || result.Message != expected.Message {
+			t.Errorf("parseLog(%q) = %+v, want %+v", line, result, expected)
+		}
+	}
+
+	result, err := parseLog("2019-04-30T12:01:39+02:00;db.go;Transaction failed, rolling back", ';')
+	if err != nil || result.File != "db.go" || result.Message != "Transaction failed, rolling back" {
+		t.Errorf("parseLog() with ';' = %+v, %v", result, err)
+	}
+}
+
+func TestCSVParserSplit(t *testing.T) {
+	input := "2019-04-30T12:01:39+02:00,db.go,\"Transaction failed\r\n\"\"rolling\"\" back\"\r\n" +
+		"2019-04-30T12:01:42+02:00,hal9000.go,I'm sorry \"Dave\n" +
+		"2019-04-30T12:01:43+02:00,\"a,\nb.go\",done"
+	expected := []string{
+		"2019-04-30T12:01:39+02:00,db.go,\"Transaction failed\r\n\"\"rolling\"\" back\"",
+		"2019-04-30T12:01:42+02:00,hal9000.go,I'm sorry \"Dave",
+		"2019-04-30T12:01:43+02:00,\"a,\nb.go\",done",
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(input))
+	scanner.Split(NewCSVParser(',').(RecordSplitter).Split)
+	var records []string
+	for scanner.Scan() {
+		records = append(records, scanner.Text())
+	}
+
+	if len(records) != len(expected) {
+		t.Fatalf("Split returned %d records, want %d: %q", len(records), len(expected), records)
+	}
+	for i := range expected {
+		if records[i] != expected[i] {
+			t.Errorf("record %d = %q, want %q", i, records[i], expected[i])
+		}
+	}
+}
+
+func TestParseRFC3164(t *testing.T) {
+	line := `<34>Dec 31 23:59:59 mymachine sshd[4721]: Accepted publickey for root`
+	match := rfc3164Pattern.FindStringSubmatch(line)
+	if match == nil {
+		t.Fatalf("rfc3164Pattern did not match %q", line)
+	}
+
+	// Without a year, a date more than a day ahead is taken from the previous year
+	tests := map[time.Time]time.Time{
+		time.Date(2019, 12, 31, 23, 0, 0, 0, time.UTC): time.Date(2019, 12, 31, 23, 59, 59, 0, time.UTC),
+		time.Date(2020, 1, 1, 0, 5, 0, 0, time.UTC):    time.Date(2019, 12, 31, 23, 59, 59, 0, time.UTC),
+		time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC):  time.Date(2019, 12, 31, 23, 59, 59, 0, time.UTC),
+		time.Date(2019, 12, 30, 23, 0, 0, 0, time.UTC): time.Date(2018, 12, 31, 23, 59, 59, 0, time.UTC),
+	}
+	for now, expected := range tests {
+		result, err := parseRFC3164(match, now)
+		if err != nil {
+			t.Fatalf("parseRFC3164 returned an error: %v", err)
+		}
+		if !result.Timestamp.Equal(expected) || result.File != "sshd" || result.Message != "Accepted publickey for root" {
+			t.Errorf("parseRFC3164() at %s = %+v, want %s sshd", now, result, expected)
+		}
+	}
+}
+
+func TestParsersRejectOtherFormats(t *testing.T) {
+	lines := map[string]string{
+		"csv":      "2019-04-30T12:01:39+02:00,network.go,Network connection established",
+		"json":     `{"time":"2019-04-30T12:01:39+02:00","msg":"Network connection established"}`,
+		"logfmt":   `time=2019-04-30T12:01:39+02:00 msg="Network connection established"`,
+		"syslog":   `Apr 30 10:01:39 mymachine sshd[4721]: Accepted publickey for root`,
+		"combined": `127.0.0.1 - - [30/Apr/2019:12:01:39 +0200] "GET / HTTP/1.1" 200 612`,
+		"golog":    `2019/04/30 10:01:39 network.go:42: Network connection established`,
+	}
+
+	for format := range lines {
+		parser, _ := ParserFor(format)
+		for other, line := range lines {
+			if other == format {
+				continue
+			}
+			if _, err := parser.Parse(line); err == nil {
+				t.Errorf("%s parser accepted a %s line: %q", format, other, line)
+			}
+		}
+	}
+}
+
+func TestParserForUnknownFormat(t *testing.T) {
+	if _, err := ParserFor("xml"); err == nil {
+		t.Error("ParserFor(\"xml\") should have returned an error")
+	}
+}
+
+func TestDetectParser(t *testing.T) {
+	lines := []string{
+		`{"time":"2019-04-30T12:01:39+02:00","file":"network.go","msg":"Network connection established"}`,
+		``,
+		`{"time":"2019-04-30T12:01:42+02:00","file":"db.go","msg":"Transaction failed"}`,
+		`not a log line`,
+	}
+	if parser := DetectParser(lines); parser != (jsonParser{}) {
+		t.Errorf("DetectParser() = %T, want jsonParser", parser)
+	}
+
+	if parser := DetectParser([]string{"not a log line"}); parser != (csvParser{comma: ','}) {
+		t.Errorf("DetectParser() = %T, want csvParser", parser)
+	}
+}
+
+func TestRejectionReason(t *testing.T) {
+	tests := []struct {
+		format string
+		line   string
+		reason string
+	}{
+		{"csv", "not a log line", "malformed"},
+		{"csv", "30/04/2019,db.go,Transaction failed", "invalid timestamp"},
+		{"json", `{"file":"db.go","msg":"Transaction failed"}`, "missing timestamp"},
+		{"json", `{"time":true,"msg":"Transaction failed"}`, "invalid timestamp"},
+		{"logfmt", `time=2019-04-30T12:01:42+02:00 file=db.go`, "missing message"},
+		{"syslog", `<34>1 - mymachine su - - - 'su root' failed`, "missing timestamp"},
+		{"combined", `127.0.0.1 - - [30/Apr/2019:25:01:42 +0200] "GET / HTTP/1.1" 200 12`, "invalid timestamp"},
+	}
+	for _, test := range tests {
+		parser, _ := ParserFor(test.format)
+		_, err := parser.Parse(test.line)
+		if reason := RejectionReason(err); reason != test.reason {
+			t.Errorf("%s: RejectionReason(%v) = %q, want %q", test.format, err, reason, test.reason)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	var report Report
+	report.Lines = 4
+	report.Reject(2, "not a log line", errors.New("invalid log entry"), 1)
+	report.Reject(4, "30/04/2019,db.go,Transaction failed", ErrInvalidTimestamp, 1)
+
+	expected := Report{
+		Lines:    4,
+		Rejected: 2,
+		Reasons:  map[string]int{"malformed": 1, "invalid timestamp": 1},
+		Samples:  []RejectedLine{{Line: 2, Reason: "malformed", Text: "not a log line"}},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("report = %+v, want %+v", report, expected)
+	}
+	if rate := report.ErrorRate(); rate != 0.5 {
+		t.Errorf("ErrorRate() = %v, want 0.5", rate)
+	}
+}
+
+func mustParse(value string) time.Time {
+	timestamp, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		panic(err)
+	}
+	return timestamp
+}
@@ -1,8 +1,11 @@
 package processor
 
 import (
+	"context"
+	"encoding/csv"
 	"fmt"
-	"log"
+	"loglizer/window"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -14,58 +17,235 @@ type LogEntry struct {
 	Message   string
 }
 
-func SummarizeLogFrequency(logEntriesChan <-chan []string, processedLogsChan chan<- string, wg *sync.WaitGroup) {
+// Batch is a group of log entries covering one time window, parsed by the
+// reader as it found their window. Seq is the position of the window in the
+// input, starting at 0, so results can be put back in order. Large windows
+// are split into several batches, the parts of the window, so that they are
+// processed in parallel.
+type Batch struct {
+	Seq int
+	// Position of the batch among the parts of its window, starting at 0.
+	Part int
+	// Whether the batch is the last part of its window.
+	Last    bool
+	Start   time.Time
+	End     time.Time
+	Entries []LogEntry
+	// Lines of the window that were dropped because the parser rejected them.
+	Unparsable int
+	// Number of bytes of the lines Entries were parsed from, which they hold.
+	Size int
+}
+
+// entryBuffers holds the Entries of batches already counted, so that the
+// reader fills them again instead of growing a new slice for every part of a
+// window.
+var entryBuffers sync.Pool
+
+// NewEntries returns an empty slice to gather the entries of a batch in,
+// reusing the Entries of a batch already counted when there is one.
+func NewEntries() []LogEntry {
+	if entries, ok := entryBuffers.Get().(*[]LogEntry); ok {
+		return *entries
+	}
+	return nil
+}
+
+// releaseEntries makes the entries of a batch once counted available to
+// NewEntries. They must not be used afterwards.
+func releaseEntries(entries []LogEntry) {
+	if cap(entries) == 0 {
+		return
+	}
+	// The lines the entries were parsed from are no longer held
+	clear(entries)
+	entries = entries[:0]
+	entryBuffers.Put(&entries)
+}
+
+// Result holds the counts of the batch with the same Seq and Part.
+type Result struct {
+	Seq   int
+	Part  int
+	Last  bool
+	Start time.Time
+	End   time.Time
+	// Entries of the batch, counted by file and message.
+	Counts *Counter
+	// Lines of the batch that could not be parsed.
+	Unparsable int
+	// Size of the batch counted, whose lines are no longer held.
+	Size int
+}
+
+// Merge adds the counts of next, the result of the following part of the same
+// window, to r.
+func (r *Result) Merge(next Result) {
+	r.Counts.Merge(next.Counts)
+	r.Unparsable += next.Unparsable
+	r.Size += next.Size
+	r.Part = next.Part
+	r.Last = next.Last
+}
+
+// Summary returns the summary of the window counted by r, once the results of
+// all of its parts have been merged.
+func (r Result) Summary(options Options) Summary {
+	top, distinct := r.Counts.Top(options.Top)
+	date, timeOfDay := options.Window.Format(r.Start)
+	return Summary{
+		Start:      r.Start,
+		End:        r.End,
+		Date:       date,
+		TimeOfDay:  timeOfDay,
+		Top:        top,
+		Total:      r.Counts.Total(),
+		Distinct:   distinct,
+		Unparsable: r.Unparsable,
+	}
+}
+
+// Summary describes the most frequent messages of one time window.
+type Summary struct {
+	Start time.Time
+	End   time.Time
+	// Start of the window formatted for the CSV output, e.g. MMDDYYYY and HH
+	// for hourly windows.
+	Date      string
+	TimeOfDay string
+	Top       []LogCount
+	// Number of parsed lines in the window.
+	Total int
+	// Number of different "file,message" pairs in the window.
+	Distinct int
+	// Number of lines of the window that could not be parsed.
+	Unparsable int
+}
+
+// LogCount is the number of occurrences of a "file,message" pair within a
+// window. Share is Count divided by the number of parsed lines in the window.
+// When messages are grouped by template, Template is the template counted and
+// Message the first message seen that matches it.
+type LogCount struct {
+	File     string
+	Message  string
+	Template string
+	Count    int
+	Share    float64
+}
+
+type Options struct {
+	// Number of most frequent messages to keep per window. Values below 1 are
+	// treated as 1.
+	Top int
+	// Window the batches were grouped by, used to format their start.
+	Window window.Window
+	// How messages differing only by their variable parts are grouped.
+	Templates TemplateMode
+}
+
+// SummarizeLogFrequency counts the entries of the batches received until
+// logEntriesChan is closed or ctx is done. The Entries of each batch are reused
+// once counted.
+func SummarizeLogFrequency(ctx context.Context, logEntriesChan <-chan Batch, processedLogsChan chan<- Result, options Options, wg *sync.WaitGroup) {
 	defer wg.Done()
-	for lines := range logEntriesChan {
-		var entries []LogEntry
-		for _, line := range lines {
-			entry, err := parseLog(line)
-			if err != nil {
-				log.Printf("error parsing log entry: %s", err)
-				continue
+	for {
+		var batch Batch
+		var ok bool
+		select {
+		case batch, ok = <-logEntriesChan:
+			if !ok {
+				return
 			}
-			entries = append(entries, entry)
+		case <-ctx.Done():
+			return
+		}
+		result := Result{
+			Seq:        batch.Seq,
+			Part:       batch.Part,
+			Last:       batch.Last,
+			Start:      batch.Start,
+			End:        batch.End,
+			Counts:     NewCounter(options.Templates),
+			Unparsable: batch.Unparsable,
+			Size:       batch.Size,
+		}
+		for _, entry := range batch.Entries {
+			result.Counts.Add(entry.File, entry.Message)
+		}
+		releaseEntries(batch.Entries)
+		select {
+		case processedLogsChan <- result:
+		case <-ctx.Done():
+			return
 		}
-		dateHour, mostFrequent := findMostFrequentLog(entries)
-		processedLogsChan <- fmt.Sprintf("%s,%s", dateHour, mostFrequent)
 	}
 }
 
-func findMostFrequentLog(entries []LogEntry) (string, string) {
-	frequencyMap := make(map[string]int)
-	var maxCount int
-	var mostFrequentLog string
-	var timestamp time.Time
-
-	for _, entry := range entries {
-		log := fmt.Sprintf("%s,%s", entry.File, entry.Message)
-		frequencyMap[log]++
-		if frequencyMap[log] > maxCount {
-			maxCount = frequencyMap[log]
-			mostFrequentLog = log
-
-			// Keep track of the timestamp for formatting
-			timestamp = entry.Timestamp
-		}
+// Columns of the records returned by Summary.Records.
+var Columns = []string{"date", "time", "rank", "count", "share", "total", "distinct", "unparsable", "file", "message", "template"}
+
+// Records formats the summary as CSV records, one per ranked message, with the
+// fields listed in Columns. A window without any parsed line gets a single
+// record with rank 0 and empty file and message, so its unparsable lines are
+// still reported.
+func (s Summary) Records() [][]string {
+	if len(s.Top) == 0 {
+		return [][]string{s.record(0, LogCount{})}
 	}
+	records := make([][]string, 0, len(s.Top))
+	for i, logCount := range s.Top {
+		records = append(records, s.record(i+1, logCount))
+	}
+	return records
+}
 
-	// New date and hour format: MMDDYYYY,HH
-	dateHour := timestamp.Format("01022006,15")
-	return dateHour, mostFrequentLog
+func (s Summary) record(rank int, logCount LogCount) []string {
+	return []string{
+		s.Date,
+		s.TimeOfDay,
+		strconv.Itoa(rank),
+		strconv.Itoa(logCount.Count),
+		strconv.FormatFloat(logCount.Share, 'f', 4, 64),
+		strconv.Itoa(s.Total),
+		strconv.Itoa(s.Distinct),
+		strconv.Itoa(s.Unparsable),
+		logCount.File,
+		logCount.Message,
+		logCount.Template,
+	}
 }
 
-func parseLog(line string) (LogEntry, error) {
-	parts := strings.SplitN(line, ",", 3)
-	if len(parts) != 3 {
+// parseLog reads a "timestamp,file,message" record with CSV quoting rules.
+// Unquoted delimiters after the second one are part of the message.
+func parseLog(line string, comma rune) (LogEntry, error) {
+	// Records without quotes are split in place, without the allocations of
+	// a csv.Reader
+	if !strings.ContainsAny(line, "\"\r\n") {
+		separator := string(comma)
+		date, rest, ok := strings.Cut(line, separator)
+		file, message, ok2 := strings.Cut(rest, separator)
+		if !ok || !ok2 {
+			return LogEntry{}, fmt.Errorf("invalid log entry: %s", line)
+		}
+		return newLogEntry(date, file, message)
+	}
+
+	reader := csv.NewReader(strings.NewReader(line))
+	reader.Comma = comma
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	parts, err := reader.Read()
+	if err != nil || len(parts) < 3 {
 		return LogEntry{}, fmt.Errorf("invalid log entry: %s", line)
 	}
-	timestamp, err := time.Parse(time.RFC3339, parts[0])
+	return newLogEntry(parts[0], parts[1], strings.Join(parts[2:], string(comma)))
+}
+
+func newLogEntry(date, file, message string) (LogEntry, error) {
+	timestamp, err := time.Parse(time.RFC3339, date)
 	if err != nil {
-		return LogEntry{}, err
+		return LogEntry{}, fmt.Errorf("%w: %w", ErrInvalidTimestamp, err)
 	}
-	return LogEntry{
-		Timestamp: timestamp,
-		File:      parts[1],
-		Message:   parts[2],
-	}, nil
+	return LogEntry{Timestamp: timestamp, File: file, Message: message}, nil
 }
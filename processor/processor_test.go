@@ -1,6 +1,11 @@
 package processor
 
 import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -14,7 +19,7 @@ func TestParseLog(t *testing.T) {
 		File:      "network.go",
 		Message:   "Network connection established",
 	}
-	result, err := parseLog(input)
+	result, err := parseLog(input, ',')
 	if err != nil {
 		t.Errorf("parseLogEntry returned an error: %v", err)
 	}
@@ -24,42 +29,86 @@ func TestParseLog(t *testing.T) {
 	}
 }
 
-func TestFindMostFrequentLog(t *testing.T) {
+func TestCounterTop(t *testing.T) {
 	// The most frequent message is "Error: Meme generator ran out of memes" in the test entries batch
-	expectedLog := "memeGenerator.go,Error: Meme generator ran out of memes"
+	expected := []LogCount{
+		{File: "memeGenerator.go", Message: "Error: Meme generator ran out of memes", Count: 20, Share: 20.0 / 80},
+		{File: "authentication.go", Message: "Error: Failed to authenticate user", Count: 8, Share: 8.0 / 80},
+		// Tied with authorization.go at 7, but seen first
+		{File: "server.go", Message: "Error: Server is not responding", Count: 7, Share: 7.0 / 80},
+	}
+
+	counts := NewCounter(NoTemplates)
+	for _, entry := range logEntries {
+		counts.Add(entry.File, entry.Message)
+	}
+	top, distinct := counts.Top(3)
+
+	if distinct != 17 {
+		t.Errorf("Top() distinct = %d; want 17", distinct)
+	}
+	if len(top) != len(expected) {
+		t.Fatalf("Top() returned %d entries; want %d", len(top), len(expected))
+	}
+	for i := range expected {
+		if top[i] != expected[i] {
+			t.Errorf("Top()[%d] = %+v; want %+v", i, top[i], expected[i])
+		}
+	}
+}
 
-	expectedDateHour := "04302019,12"
+func TestCounterTopTieBreak(t *testing.T) {
+	// "server.go" and "theMatrix.go" both appear twice; "server.go" was seen first
+	entries := []LogEntry{
+		{File: "server.go", Message: "Error: Server is not responding"},
+		{File: "theMatrix.go", Message: "Error: There is no spoon"},
+		{File: "cache.go", Message: "Cache created"},
+		{File: "theMatrix.go", Message: "Error: There is no spoon"},
+		{File: "server.go", Message: "Error: Server is not responding"},
+	}
 
-	dateHour, mostFrequentLog := findMostFrequentLog(logEntries)
+	counts := NewCounter(NoTemplates)
+	for _, entry := range entries {
+		counts.Add(entry.File, entry.Message)
+	}
+	top, _ := counts.Top(2)
 
-	if dateHour != expectedDateHour || mostFrequentLog != expectedLog {
-		t.Errorf("findMostFrequentLog() = %v, %v; want %v, %v", dateHour, mostFrequentLog, expectedDateHour, expectedLog)
+	if len(top) != 2 || top[0].File != "server.go" || top[1].File != "theMatrix.go" {
+		t.Errorf("Top() = %+v; want server.go then theMatrix.go", top)
 	}
 }
 
 func TestSummarizeLogFrequency(t *testing.T) {
 	// Setup: Create channels and a WaitGroup
-	logEntriesChan := make(chan []string)
-	processedLogsChan := make(chan string, 10)
+	logEntriesChan := make(chan Batch)
+	processedLogsChan := make(chan Result, 10)
 	var wg sync.WaitGroup
 
-	mockLines := []string{
+	var entries []LogEntry
+	for _, line := range []string{
 		"2019-04-30T12:01:39+02:00,network.go,Network connection established",
 		"2019-04-30T12:01:42+02:00,db.go,Transaction failed",
 		"2019-04-30T12:06:19+02:00,memeGenerator.go,Error: Meme generator ran out of memes",
 		"2019-04-30T12:06:19+02:00,memeGenerator.go,Error: Meme generator ran out of memes",
+	} {
+		entry, err := parseLog(line, ',')
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
 	}
+	start, _ := time.Parse(time.RFC3339, "2019-04-30T12:01:39+02:00")
 
 	// Expected output
-	expectedOutput := "04302019,12,memeGenerator.go,Error: Meme generator ran out of memes"
+	expectedOutput := "04302019,12,1,2,0.5000,4,3,2,memeGenerator.go,Error: Meme generator ran out of memes,"
 
 	// Start the function in a goroutine
 	wg.Add(1)
-	go SummarizeLogFrequency(logEntriesChan, processedLogsChan, &wg)
+	go SummarizeLogFrequency(context.Background(), logEntriesChan, processedLogsChan, Options{Top: 1}, &wg)
 
 	// Send mock data to the channel
 	go func() {
-		logEntriesChan <- mockLines
+		logEntriesChan <- Batch{Seq: 7, Start: start, Entries: entries, Unparsable: 2}
 		close(logEntriesChan)
 	}()
 
@@ -73,8 +122,13 @@ func TestSummarizeLogFrequency(t *testing.T) {
 		t.Fatal("Processed logs channel doesn't contain the received result.")
 	}
 
-	if receivedOutput != expectedOutput {
-		t.Errorf("SummarizeLogFrequency output = %v, want %v", receivedOutput, expectedOutput)
+	records := receivedOutput.Summary(Options{Top: 1}).Records()
+	if len(records) != 1 || strings.Join(records[0], ",") != expectedOutput {
+		t.Errorf("SummarizeLogFrequency output = %v, want %v", records, expectedOutput)
+	}
+
+	if receivedOutput.Seq != 7 {
+		t.Errorf("SummarizeLogFrequency sequence = %d, want 7", receivedOutput.Seq)
 	}
 }
 
@@ -480,3 +534,83 @@ var logEntries = []LogEntry{
 		Message:   "Error: Meme generator ran out of memes",
 	},
 }
+
+func BenchmarkSummarizeLogFrequency(b *testing.B) {
+	// One busy hour with a few hundred distinct messages
+	entries := make([]LogEntry, 100000)
+	size := 0
+	for i := range entries {
+		line := fmt.Sprintf("2019-04-30T12:%02d:%02d+02:00,service%d.go,Request %d failed after %dms", i/1700%60, i%60, i%7, i%53, i%300)
+		entries[i], _ = parseLog(line, ',')
+		size += len(line)
+	}
+	start := time.Date(2019, 4, 30, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+
+	for _, mode := range []TemplateMode{NoTemplates, MaskTemplates, DrainTemplates} {
+		b.Run(fmt.Sprintf("templates=%d", mode), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// The entries of a counted batch are cleared for reuse
+				b.StopTimer()
+				logEntriesChan := make(chan Batch, 1)
+				processedLogsChan := make(chan Result, 1)
+				logEntriesChan <- Batch{Start: start, Entries: slices.Clone(entries), Size: size}
+				close(logEntriesChan)
+				b.StartTimer()
+				var wg sync.WaitGroup
+				wg.Add(1)
+				SummarizeLogFrequency(context.Background(), logEntriesChan, processedLogsChan, Options{Top: 10, Templates: mode}, &wg)
+				<-processedLogsChan
+			}
+		})
+	}
+}
+
+func TestCounterMerge(t *testing.T) {
+	messages := []string{
+		"Request 12 failed after 31ms",
+		"Cache miss",
+		"Request 7 failed after 48ms",
+		"Request 12 failed after 31ms",
+		"Cache miss",
+		"Request 3 failed after 5ms",
+		"Cache miss",
+	}
+	for _, mode := range []TemplateMode{NoTemplates, MaskTemplates, DrainTemplates} {
+		whole := NewCounter(mode)
+		for _, message := range messages {
+			whole.Add("app.go", message)
+		}
+
+		// Counted in three parts, merged in order
+		merged := NewCounter(mode)
+		for _, part := range [][]string{messages[:2], messages[2:3], messages[3:]} {
+			counts := NewCounter(mode)
+			for _, message := range part {
+				counts.Add("app.go", message)
+			}
+			merged.Merge(counts)
+		}
+
+		expected, expectedDistinct := whole.Top(10)
+		top, distinct := merged.Top(10)
+		if !reflect.DeepEqual(top, expected) || distinct != expectedDistinct || merged.Total() != len(messages) {
+			t.Errorf("templates=%d: merged counts = %+v, %d, want %+v, %d", mode, top, distinct, expected, expectedDistinct)
+		}
+	}
+}
+
+func TestCounterMaskCache(t *testing.T) {
+	counts := NewCounter(MaskTemplates)
+	for i := 0; i < 3*maxMaskCache; i++ {
+		counts.Add("app.go", fmt.Sprintf("Request %d failed", i%(2*maxMaskCache)))
+		if len(counts.masks) > maxMaskCache {
+			t.Fatalf("%d masked messages kept, want at most %d", len(counts.masks), maxMaskCache)
+		}
+	}
+	top, distinct := counts.Top(1)
+	if distinct != 1 || top[0].Count != 3*maxMaskCache || top[0].Template != "Request <NUM> failed" {
+		t.Errorf("got %+v, %d distinct", top, distinct)
+	}
+}
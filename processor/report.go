@@ -0,0 +1,71 @@
+package processor
+
+// Longest text of a rejected line kept in a report, in bytes.
+const maxSampleLength = 1024
+
+// Report describes the lines of an input rejected by its parser.
+type Report struct {
+	// Number of lines read, the skipped header excluded.
+	Lines int
+	// Number of lines the parser rejected.
+	Rejected int
+	// Number of rejected lines by reason, as returned by RejectionReason.
+	Reasons map[string]int
+	// First lines rejected, in input order.
+	Samples []RejectedLine
+}
+
+// RejectedLine is a line rejected by a parser.
+type RejectedLine struct {
+	// Position of the line in the input, starting at 1.
+	Line   int
+	Reason string
+	// Text of the line, cut to 1 KiB.
+	Text string
+}
+
+// Reject counts a line rejected with err, and keeps it as a sample while
+// fewer than maxSamples are kept.
+func (r *Report) Reject(line int, text string, err error, maxSamples int) {
+	reason := RejectionReason(err)
+	r.Rejected++
+	if r.Reasons == nil {
+		r.Reasons = make(map[string]int)
+	}
+	r.Reasons[reason]++
+	if len(r.Samples) < maxSamples {
+		if len(text) > maxSampleLength {
+			text = text[:maxSampleLength]
+		}
+		r.Samples = append(r.Samples, RejectedLine{Line: line, Reason: reason, Text: text})
+	}
+}
+
+// ErrorRate returns the share of the lines read that were rejected.
+func (r *Report) ErrorRate() float64 {
+	if r.Lines == 0 {
+		return 0
+	}
+	return float64(r.Rejected) / float64(r.Lines)
+}
+
+// Merge adds the lines of other, which reported on the part of the input that
+// follows the one reported on by r and whose lines are numbered from
+// lineOffset+1 in the input. Samples are kept while fewer than maxSamples are.
+func (r *Report) Merge(other Report, lineOffset, maxSamples int) {
+	r.Lines += other.Lines
+	r.Rejected += other.Rejected
+	for reason, count := range other.Reasons {
+		if r.Reasons == nil {
+			r.Reasons = make(map[string]int)
+		}
+		r.Reasons[reason] += count
+	}
+	for _, sample := range other.Samples {
+		if len(r.Samples) >= maxSamples {
+			break
+		}
+		sample.Line += lineOffset
+		r.Samples = append(r.Samples, sample)
+	}
+}
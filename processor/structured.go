@@ -0,0 +1,165 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keys looked up, in order, to find the fields of a LogEntry in JSON and
+// logfmt lines.
+var (
+	timeKeys    = []string{"time", "ts", "timestamp", "@timestamp", "t"}
+	fileKeys    = []string{"file", "caller", "source", "logger"}
+	messageKeys = []string{"msg", "message"}
+)
+
+// jsonParser reads one JSON object per line.
+type jsonParser struct{}
+
+func (jsonParser) Parse(line string) (LogEntry, error) {
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return LogEntry{}, fmt.Errorf("invalid JSON log entry: %w", err)
+	}
+
+	var timestamp time.Time
+	var err error
+	switch value := lookup(fields, timeKeys).(type) {
+	case string:
+		if timestamp, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			err = fmt.Errorf("%w: %w", ErrInvalidTimestamp, err)
+		}
+	case float64:
+		timestamp = fromEpoch(value)
+	case nil:
+		err = ErrMissingTimestamp
+	default:
+		err = fmt.Errorf("%w %v", ErrInvalidTimestamp, value)
+	}
+	if err != nil {
+		return LogEntry{}, fmt.Errorf("invalid JSON log entry: %w", err)
+	}
+
+	message, ok := lookup(fields, messageKeys).(string)
+	if !ok {
+		return LogEntry{}, fmt.Errorf("invalid JSON log entry: %w", ErrMissingMessage)
+	}
+	file, _ := lookup(fields, fileKeys).(string)
+
+	return LogEntry{Timestamp: timestamp, File: file, Message: message}, nil
+}
+
+// logfmtParser reads key=value pairs separated by spaces, with values
+// optionally double quoted.
+type logfmtParser struct{}
+
+func (logfmtParser) Parse(line string) (LogEntry, error) {
+	pairs, err := splitLogfmt(line)
+	if err != nil {
+		return LogEntry{}, fmt.Errorf("invalid logfmt log entry: %w", err)
+	}
+	fields := make(map[string]any, len(pairs))
+	for key, value := range pairs {
+		fields[key] = value
+	}
+
+	value, ok := lookup(fields, timeKeys).(string)
+	if !ok {
+		return LogEntry{}, fmt.Errorf("invalid logfmt log entry: %w", ErrMissingTimestamp)
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		seconds, numErr := strconv.ParseFloat(value, 64)
+		if numErr != nil {
+			return LogEntry{}, fmt.Errorf("invalid logfmt log entry: %w: %w", ErrInvalidTimestamp, err)
+		}
+		timestamp = fromEpoch(seconds)
+	}
+
+	message, ok := lookup(fields, messageKeys).(string)
+	if !ok {
+		return LogEntry{}, fmt.Errorf("invalid logfmt log entry: %w", ErrMissingMessage)
+	}
+	file, _ := lookup(fields, fileKeys).(string)
+
+	return LogEntry{Timestamp: timestamp, File: file, Message: message}, nil
+}
+
+func splitLogfmt(line string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' && line[i] != '\t' {
+			i++
+		}
+		key := line[start:i]
+		if key == "" || strings.ContainsAny(key, `"`) {
+			return nil, fmt.Errorf("invalid key at offset %d", start)
+		}
+		if i == len(line) || line[i] != '=' {
+			// A key without value is a boolean flag
+			pairs[key] = "true"
+			continue
+		}
+		i++
+
+		if i < len(line) && line[i] == '"' {
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("unterminated value for key %q", key)
+			}
+			value, err := strconv.Unquote(line[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for key %q: %w", key, err)
+			}
+			pairs[key] = value
+			i = end + 1
+			continue
+		}
+
+		start = i
+		for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			i++
+		}
+		pairs[key] = line[start:i]
+	}
+	if len(pairs) == 0 {
+		return nil, errors.New("no key=value pair")
+	}
+	return pairs, nil
+}
+
+func lookup(fields map[string]any, keys []string) any {
+	for _, key := range keys {
+		if value, ok := fields[key]; ok {
+			return value
+		}
+	}
+	return nil
+}
+
+// fromEpoch converts a Unix time in seconds, or in milliseconds for values too
+// large to be seconds of a realistic date, to a UTC time.
+func fromEpoch(value float64) time.Time {
+	if value > 1e11 {
+		value /= 1000
+	}
+	seconds, fraction := math.Modf(value)
+	return time.Unix(int64(seconds), int64(fraction*1e9)).UTC()
+}
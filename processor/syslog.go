@@ -0,0 +1,105 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+	rfc5424Pattern = regexp.MustCompile(`^<\d{1,3}>1 (\S+) \S+ (\S+) \S+ \S+ (.*)$`)
+	// [<PRI>]Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG, PRI being left out in
+	// files written by syslog daemons
+	rfc3164Pattern = regexp.MustCompile(`^(?:<\d{1,3}>)?([A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2}) \S+ ([^\s:\[]+)(?:\[[^\]]*\])?: ?(.*)$`)
+)
+
+// syslogParser reads RFC 5424 and RFC 3164 syslog lines. The application
+// name or tag is used as the file. RFC 3164 timestamps have neither year nor
+// time zone: they are read as UTC, in the current year unless that would put
+// them more than a day in the future.
+type syslogParser struct{}
+
+func (syslogParser) Parse(line string) (LogEntry, error) {
+	if match := rfc5424Pattern.FindStringSubmatch(line); match != nil {
+		return parseRFC5424(match)
+	}
+	if match := rfc3164Pattern.FindStringSubmatch(line); match != nil {
+		return parseRFC3164(match, time.Now())
+	}
+	return LogEntry{}, fmt.Errorf("invalid syslog entry: %s", line)
+}
+
+func parseRFC5424(match []string) (LogEntry, error) {
+	if match[1] == "-" {
+		return LogEntry{}, fmt.Errorf("invalid syslog entry: %w", ErrMissingTimestamp)
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, match[1])
+	if err != nil {
+		return LogEntry{}, fmt.Errorf("invalid syslog entry: %w: %w", ErrInvalidTimestamp, err)
+	}
+
+	file := match[2]
+	if file == "-" {
+		file = ""
+	}
+
+	message, err := skipStructuredData(match[3])
+	if err != nil {
+		return LogEntry{}, fmt.Errorf("invalid syslog entry: %w", err)
+	}
+	message = strings.TrimPrefix(message, "\ufeff")
+
+	return LogEntry{Timestamp: timestamp, File: file, Message: message}, nil
+}
+
+// skipStructuredData returns what follows the STRUCTURED-DATA field of an RFC
+// 5424 message, which is either "-" or a list of [id param="value" ...]
+// elements where values may contain escaped quotes and brackets.
+func skipStructuredData(s string) (string, error) {
+	if strings.HasPrefix(s, "-") {
+		return strings.TrimPrefix(s[1:], " "), nil
+	}
+
+	i := 0
+	for i < len(s) && s[i] == '[' {
+		inValue := false
+		for i++; i < len(s); i++ {
+			if inValue && s[i] == '\\' {
+				i++
+				continue
+			}
+			if s[i] == '"' {
+				inValue = !inValue
+			}
+			if !inValue && s[i] == ']' {
+				break
+			}
+		}
+		if i == len(s) {
+			return "", errors.New("unterminated structured data")
+		}
+		i++
+	}
+	if i == 0 {
+		return "", errors.New("missing structured data")
+	}
+	return strings.TrimPrefix(s[i:], " "), nil
+}
+
+func parseRFC3164(match []string, now time.Time) (LogEntry, error) {
+	timestamp, err := time.Parse(time.Stamp, match[1])
+	if err != nil {
+		return LogEntry{}, fmt.Errorf("invalid syslog entry: %w: %w", ErrInvalidTimestamp, err)
+	}
+
+	now = now.UTC()
+	timestamp = timestamp.AddDate(now.Year(), 0, 0)
+	if timestamp.After(now.AddDate(0, 0, 1)) {
+		timestamp = timestamp.AddDate(-1, 0, 0)
+	}
+
+	return LogEntry{Timestamp: timestamp, File: match[2], Message: match[3]}, nil
+}
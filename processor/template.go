@@ -0,0 +1,177 @@
+package processor
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// TemplateMode selects how messages that only differ by their variable parts
+// are counted together.
+type TemplateMode int
+
+const (
+	// Messages are counted as written.
+	NoTemplates TemplateMode = iota
+	// Quoted strings, timestamps, UUIDs, IP addresses, hexadecimal IDs and
+	// numbers are replaced by placeholders such as <NUM> before counting.
+	MaskTemplates
+	// Masked messages are further grouped with the Drain algorithm, which
+	// replaces the tokens that differ between similar messages with <*>.
+	DrainTemplates
+)
+
+// ParseTemplateMode reads a template mode from "none", "mask" or "drain".
+func ParseTemplateMode(s string) (TemplateMode, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return NoTemplates, nil
+	case "mask":
+		return MaskTemplates, nil
+	case "drain":
+		return DrainTemplates, nil
+	}
+	return NoTemplates, fmt.Errorf("unknown template mode %q, expected none, mask or drain", s)
+}
+
+// Masks applied in order, so that e.g. the digits of a UUID are not masked as
+// numbers first.
+var masks = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`"(?:[^"\\]|\\.)*"`), "<STR>"},
+	{regexp.MustCompile(`(^|[\s=:(\[])'[^']*'`), "$1<STR>"},
+	// ISO 8601 dates, with their time and offset if any
+	{regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}(?:[T ]\d{2}:\d{2}(?::\d{2}(?:[.,]\d+)?)?(?:Z|[+-]\d{2}:?\d{2})?)?\b`), "<TS>"},
+	{regexp.MustCompile(`\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`), "<UUID>"},
+	{regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}(?::\d+)?\b`), "<IP>"},
+	{regexp.MustCompile(`\b(?:[0-9a-fA-F]{1,4}:){7}[0-9a-fA-F]{1,4}\b|\b(?:[0-9a-fA-F]{1,4}:){1,6}(?::[0-9a-fA-F]{1,4}){1,6}\b|\b(?:[0-9a-fA-F]{1,4}:){1,6}:`), "<IP>"},
+	{regexp.MustCompile(`\b0[xX][0-9a-fA-F]+\b`), "<HEX>"},
+}
+
+// Hexadecimal IDs without 0x prefix are at least 6 characters long and mix
+// digits and letters, so that words such as "facade" are left alone.
+var hexPattern = regexp.MustCompile(`\b[0-9a-fA-F]{6,}\b`)
+
+var numberPattern = regexp.MustCompile(`\b\d+(?:\.\d+)?`)
+
+// maskMessage replaces the variable parts of a message with placeholders.
+func maskMessage(message string) string {
+	for _, mask := range masks {
+		message = mask.pattern.ReplaceAllString(message, mask.replacement)
+	}
+	message = hexPattern.ReplaceAllStringFunc(message, func(word string) string {
+		hasDigit := strings.IndexFunc(word, unicode.IsDigit) >= 0
+		hasLetter := strings.IndexFunc(word, unicode.IsLetter) >= 0
+		if hasDigit && hasLetter {
+			return "<HEX>"
+		}
+		return word
+	})
+	return numberPattern.ReplaceAllString(message, "<NUM>")
+}
+
+const (
+	wildcard = "<*>"
+	// Number of leading tokens used to route a message to its clusters.
+	drainPrefixTokens = 2
+	// Maximum number of distinct tokens at one level of the prefix tree.
+	// Further tokens share the wildcard branch.
+	drainMaxChildren = 100
+	// Minimum share of identical tokens for a message to join a cluster.
+	drainSimilarity = 0.5
+)
+
+// drain groups messages into templates with the Drain algorithm: messages
+// are routed by token count and leading tokens to a small list of clusters,
+// and join the most similar one if enough tokens are identical.
+//
+// A drain is not safe for concurrent use. Templates depend on the order in
+// which messages are added, so each window uses its own.
+type drain struct {
+	root drainNode
+}
+
+type drainNode struct {
+	children map[string]*drainNode
+	clusters []*drainCluster
+}
+
+type drainCluster struct {
+	tokens []string
+}
+
+func (c *drainCluster) template() string {
+	return strings.Join(c.tokens, " ")
+}
+
+func newDrain() *drain {
+	return &drain{root: drainNode{children: make(map[string]*drainNode)}}
+}
+
+// add returns the cluster the message belongs to, updating its template.
+func (d *drain) add(message string) *drainCluster {
+	tokens := strings.Fields(maskMessage(message))
+
+	node := d.root.child(fmt.Sprint(len(tokens)))
+	for i := 0; i < drainPrefixTokens && i < len(tokens); i++ {
+		key := tokens[i]
+		if strings.IndexFunc(key, unicode.IsDigit) >= 0 || strings.Contains(key, "<") {
+			key = wildcard
+		}
+		if _, ok := node.children[key]; !ok && len(node.children) >= drainMaxChildren {
+			key = wildcard
+		}
+		node = node.child(key)
+	}
+
+	var best *drainCluster
+	bestSimilarity := -1.0
+	for _, cluster := range node.clusters {
+		if similarity := similarity(cluster.tokens, tokens); similarity > bestSimilarity {
+			best = cluster
+			bestSimilarity = similarity
+		}
+	}
+	if best == nil || bestSimilarity < drainSimilarity {
+		best = &drainCluster{tokens: tokens}
+		node.clusters = append(node.clusters, best)
+		return best
+	}
+
+	for i := range best.tokens {
+		if best.tokens[i] != tokens[i] {
+			best.tokens[i] = wildcard
+		}
+	}
+	return best
+}
+
+func (n *drainNode) child(key string) *drainNode {
+	if n.children == nil {
+		n.children = make(map[string]*drainNode)
+	}
+	child, ok := n.children[key]
+	if !ok {
+		child = &drainNode{}
+		n.children[key] = child
+	}
+	return child
+}
+
+// similarity returns the share of positions where the message has the same
+// token as the template. Wildcards are not counted as matches.
+func similarity(template, tokens []string) float64 {
+	if len(tokens) == 0 {
+		return 1
+	}
+	same := 0
+	for i := range template {
+		if template[i] == tokens[i] {
+			same++
+		}
+	}
+	return float64(same) / float64(len(tokens))
+}
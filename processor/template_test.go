@@ -0,0 +1,92 @@
+package processor
+
+import "testing"
+
+func TestMaskMessage(t *testing.T) {
+	tests := map[string]string{
+		"Timeout after 31ms":                                 "Timeout after <NUM>ms",
+		"Timeout after 47.5ms":                               "Timeout after <NUM>ms",
+		`Query "select * from users" failed`:                 "Query <STR> failed",
+		"User 'frank' logged in, I'm sorry":                  "User <STR> logged in, I'm sorry",
+		"Request 123e4567-e89b-12d3-a456-426614174000 done":  "Request <UUID> done",
+		"Connected to 10.0.0.12:5432":                        "Connected to <IP>",
+		"Connected to fe80::1ff:fe23:4567:890a":              "Connected to <IP>",
+		"Segfault at 0x7ffd5fbff8c8 in object 5f3a9c2e":      "Segfault at <HEX> in object <HEX>",
+		"Error: Meme generator ran out of memes":             "Error: Meme generator ran out of memes",
+		"Decorated facade of hal9000 v2":                     "Decorated facade of hal9000 v2",
+		"Listening on port 8080 since 2019-04-30T12:01:39":   "Listening on port <NUM> since <TS>",
+		"Lease expires 2019-04-30T12:01:39.123+02:00, renew": "Lease expires <TS>, renew",
+		"Backup of 2019-04-30 12:01:39Z restored":            "Backup of <TS> restored",
+		"Report for 2019-04-30 sent":                         "Report for <TS> sent",
+	}
+
+	for message, expected := range tests {
+		if result := maskMessage(message); result != expected {
+			t.Errorf("maskMessage(%q) = %q, want %q", message, result, expected)
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	miner := newDrain()
+	first := miner.add("Connection to db-1 closed by peer")
+	second := miner.add("Connection to cache closed by peer")
+	other := miner.add("Cache created")
+	third := miner.add("Connection to db-2 closed by client")
+
+	if first != second || first != third {
+		t.Fatal("Expected similar messages to share a cluster")
+	}
+	if other == first {
+		t.Fatal("Expected a different message to get its own cluster")
+	}
+	if template := first.template(); template != "Connection to <*> closed by <*>" {
+		t.Errorf("template() = %q, want %q", template, "Connection to <*> closed by <*>")
+	}
+	if template := other.template(); template != "Cache created" {
+		t.Errorf("template() = %q, want %q", template, "Cache created")
+	}
+}
+
+func TestCounterTemplates(t *testing.T) {
+	entries := []LogEntry{
+		{File: "client.go", Message: "Timeout after 31ms"},
+		{File: "db.go", Message: "Transaction failed"},
+		{File: "client.go", Message: "Timeout after 47ms"},
+		{File: "db.go", Message: "Transaction failed"},
+		{File: "client.go", Message: "Timeout after 12ms"},
+		{File: "server.go", Message: "Timeout after 99ms"},
+	}
+
+	counts := NewCounter(NoTemplates)
+	for _, entry := range entries {
+		counts.Add(entry.File, entry.Message)
+	}
+	top, distinct := counts.Top(1)
+	if top[0].Message != "Transaction failed" || top[0].Count != 2 || distinct != 5 {
+		t.Errorf("Top() without templates = %+v, %d distinct", top, distinct)
+	}
+
+	expected := LogCount{File: "client.go", Message: "Timeout after 31ms", Template: "Timeout after <NUM>ms", Count: 3, Share: 0.5}
+	for _, mode := range []TemplateMode{MaskTemplates, DrainTemplates} {
+		counts := NewCounter(mode)
+		for _, entry := range entries {
+			counts.Add(entry.File, entry.Message)
+		}
+		top, distinct := counts.Top(1)
+		if len(top) != 1 || top[0] != expected || distinct != 3 {
+			t.Errorf("Top() with mode %d = %+v, %d distinct; want %+v, 3 distinct", mode, top, distinct, expected)
+		}
+	}
+}
+
+func TestParseTemplateMode(t *testing.T) {
+	for input, expected := range map[string]TemplateMode{"": NoTemplates, "none": NoTemplates, "mask": MaskTemplates, "Drain": DrainTemplates} {
+		if mode, err := ParseTemplateMode(input); err != nil || mode != expected {
+			t.Errorf("ParseTemplateMode(%q) = %d, %v; want %d", input, mode, err, expected)
+		}
+	}
+	if _, err := ParseTemplateMode("regex"); err == nil {
+		t.Error("ParseTemplateMode(\"regex\") should have returned an error")
+	}
+}
@@ -0,0 +1,160 @@
+package reader
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// ErrUnsupportedEncoding is returned for a content encoding that cannot be
+// decompressed.
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// Magic bytes at the start of compressed inputs, by encoding.
+var magicBytes = []struct {
+	encoding string
+	magic    []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"bzip2", []byte("BZh")},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+// Encodings that can be decompressed, by Content-Encoding value.
+var encodings = map[string]string{
+	"":         "",
+	"identity": "identity",
+	"gzip":     "gzip",
+	"x-gzip":   "gzip",
+	"deflate":  "deflate",
+	"zstd":     "zstd",
+	"bzip2":    "bzip2",
+	"x-bzip2":  "bzip2",
+	"xz":       "xz",
+	"x-xz":     "xz",
+}
+
+// CheckEncoding returns ErrUnsupportedEncoding unless Decompress can read
+// inputs compressed according to encoding.
+func CheckEncoding(encoding string) error {
+	if _, ok := encodings[strings.ToLower(strings.TrimSpace(encoding))]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+	}
+	return nil
+}
+
+// Length of the longest magic, looked at to detect the encoding of an input.
+const magicLength = 6
+
+// DetectEncoding returns the encoding of the input starting with header, such
+// as "gzip", or "" when it is not compressed in a known format.
+func DetectEncoding(header []byte) string {
+	for _, format := range magicBytes {
+		if bytes.HasPrefix(header, format.magic) {
+			return format.encoding
+		}
+	}
+	return ""
+}
+
+// IsCompressedAt reports whether input starts with the magic bytes of a known
+// compression format. It reads them at offset 0, so it does not move the
+// position of a file.
+func IsCompressedAt(input io.ReaderAt) bool {
+	header := make([]byte, magicLength)
+	n, _ := input.ReadAt(header, 0)
+	return DetectEncoding(header[:n]) != ""
+}
+
+// Decompress returns the decompressed content of input, compressed according
+// to encoding, a Content-Encoding value such as "gzip", "zstd", "bzip2" or
+// "xz". When encoding is "", it is detected from the first bytes of input,
+// which is returned as it is when not compressed. Input is decompressed as it
+// is read, and closing the result does not close input.
+func Decompress(input io.Reader, encoding string) (io.ReadCloser, error) {
+	if err := CheckEncoding(encoding); err != nil {
+		return nil, err
+	}
+	encoding = encodings[strings.ToLower(strings.TrimSpace(encoding))]
+	if encoding == "" {
+		buffered := bufio.NewReader(input)
+		// An input shorter than the magic is not compressed
+		header, _ := buffered.Peek(magicLength)
+		input = buffered
+		encoding = DetectEncoding(header)
+	}
+
+	switch encoding {
+	case "", "identity":
+		return io.NopCloser(input), nil
+	case "gzip":
+		// Concatenated members, as written by log rotation, are read as one
+		return gzip.NewReader(input)
+	case "deflate":
+		return zlib.NewReader(input)
+	case "zstd":
+		decoder, err := zstd.NewReader(input, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case "bzip2":
+		return io.NopCloser(bzip2.NewReader(input)), nil
+	case "xz":
+		decoder, err := xz.NewReader(input)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(decoder), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+}
+
+// ByteCounter counts the bytes read from the readers it wraps. It may be
+// loaded while they are being read.
+type ByteCounter struct {
+	atomic.Int64
+}
+
+// Reader returns a reader of input counting the bytes read.
+func (c *ByteCounter) Reader(input io.Reader) io.Reader {
+	return &countingReader{reader: input, counter: c}
+}
+
+// ReaderAt returns a reader of input counting the bytes read.
+func (c *ByteCounter) ReaderAt(input io.ReaderAt) io.ReaderAt {
+	return &countingReaderAt{reader: input, counter: c}
+}
+
+type countingReader struct {
+	reader  io.Reader
+	counter *ByteCounter
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.counter.Add(int64(n))
+	return n, err
+}
+
+type countingReaderAt struct {
+	reader  io.ReaderAt
+	counter *ByteCounter
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.reader.ReadAt(p, off)
+	c.counter.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,161 @@
+package reader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"loglizer/processor"
+	"sort"
+)
+
+// Number of lines looked at after a tentative range boundary to find the start
+// of a record, for parsers whose records may span several lines.
+const maxAlignLines = 64
+
+// SplitRanges cuts the size bytes of input into at most n ranges of about the
+// same length, and returns the offsets at which they start followed by size.
+// Every range starts at the beginning of a line. When records may span several
+// lines, a range starts at a line that parser accepts and that follows another
+// line it accepts whose quotes are balanced, so that the rest of a quoted field
+// is not read as a record of its own. A quoted field whose lines pass this
+// check is still cut. A boundary without such lines close to it is dropped,
+// its range joining the one before.
+func SplitRanges(input io.ReaderAt, size int64, n int, parser processor.Parser) ([]int64, error) {
+	offsets := []int64{0}
+	_, records := parser.(processor.RecordSplitter)
+	for i := 1; i < n; i++ {
+		from := max(size*int64(i)/int64(n), offsets[len(offsets)-1]+1)
+		if from >= size {
+			break
+		}
+		offset, err := lineStart(input, from, size, parser, records)
+		if err != nil {
+			return nil, err
+		}
+		if offset > offsets[len(offsets)-1] && offset < size {
+			offsets = append(offsets, offset)
+		}
+	}
+	return append(offsets, size), nil
+}
+
+// lineStart returns the offset of the first line starting at or after from,
+// or -1 when no record boundary close to from is found while checkRecords is
+// set. It returns size when no line starts after from.
+func lineStart(input io.ReaderAt, from, size int64, parser processor.Parser, checkRecords bool) (int64, error) {
+	// Start one byte early to tell whether from is the start of a line
+	buffered := bufio.NewReader(io.NewSectionReader(input, from-1, size-from+1))
+	offset := from - 1
+	if _, err := skipLine(buffered, &offset); err != nil {
+		return offset, err
+	}
+	if !checkRecords {
+		return offset, nil
+	}
+
+	// Whether the line before offset is a whole record
+	previous := false
+	for i := 0; i < maxAlignLines && offset < size; i++ {
+		start := offset
+		line, err := skipLine(buffered, &offset)
+		if err != nil {
+			return offset, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		_, err = parser.Parse(string(line))
+		if err == nil && previous {
+			return start, nil
+		}
+		previous = err == nil && bytes.Count(line, []byte{'"'})%2 == 0
+	}
+	return -1, nil
+}
+
+// skipLine reads up to the end of the current line, moving offset past it. It
+// returns the line when it fits in the buffer. At the end of the input, offset
+// is where reading stopped and no error is returned.
+func skipLine(buffered *bufio.Reader, offset *int64) ([]byte, error) {
+	tooLong := false
+	for {
+		line, err := buffered.ReadSlice('\n')
+		*offset += int64(len(line))
+		if errors.Is(err, bufio.ErrBufferFull) {
+			// Too long to be looked at
+			tooLong = true
+			continue
+		}
+		if tooLong {
+			line = nil
+		}
+		if err == io.EOF {
+			return line, nil
+		}
+		return line, err
+	}
+}
+
+// CountWindows counts the entries of the lines read by scanner by window, like
+// the batches sent by ReadLogBatches once summarized, and returns them in the
+// order their windows first appear, or chronologically when merging. Lines
+// the parser rejects before the first window are not counted in any window:
+// they are returned as leading, and belong to the last window of the input
+// before scanner's. ChunkSize is ignored.
+//
+// It also returns the number of records read, the header included, so that
+// the lines of the reports and errors of consecutive ranges of an input can
+// be numbered from its start. When reading ends early, the windows read so far
+// are returned with the reason, which is a *LineError unless ctx is done.
+func CountWindows(ctx context.Context, scanner *bufio.Scanner, options Options, mode processor.TemplateMode) (windows []processor.Result, leading, records int, err error) {
+	var byStart map[int64]int
+	if options.Merge {
+		byStart = make(map[int64]int)
+	}
+
+	lines := newLineScanner(scanner, options)
+	current := -1
+	for lines.scan(ctx) {
+		if !lines.parsed {
+			if current < 0 {
+				leading++
+			} else {
+				windows[current].Unparsable++
+			}
+			continue
+		}
+
+		start := lines.start
+		if current < 0 || !windows[current].Start.Equal(start) {
+			i, ok := byStart[start.Unix()]
+			if !ok {
+				i = len(windows)
+				windows = append(windows, processor.Result{
+					Seq:    i,
+					Last:   true,
+					Start:  start,
+					End:    options.Window.End(start),
+					Counts: processor.NewCounter(mode),
+				})
+				if options.Merge {
+					byStart[start.Unix()] = i
+				}
+			}
+			current = i
+		}
+		windows[current].Counts.Add(lines.entry.File, lines.entry.Message)
+	}
+	if err := ctx.Err(); err != nil {
+		return windows, leading, lines.lineNumber, err
+	}
+
+	if options.Merge {
+		sort.Slice(windows, func(i, j int) bool {
+			return windows[i].Start.Before(windows[j].Start)
+		})
+		for i := range windows {
+			windows[i].Seq = i
+		}
+	}
+	return windows, leading, lines.lineNumber, lines.err()
+}
@@ -2,32 +2,362 @@ package reader
 
 import (
 	"bufio"
-	"log"
-	"strings"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"loglizer/processor"
+	"loglizer/window"
+	"sort"
 	"time"
 )
 
-func ReadHourlyLogBatches(scanner *bufio.Scanner, logEntriesChan chan<- []string) {
-	var lines []string
-	lastHour := -1
-	for scanner.Scan() {
-		line := scanner.Text()
+// DefaultMaxLineLength is the length of the longest line read when
+// Options.MaxLineLength is not set.
+const DefaultMaxLineLength = 1024 * 1024
 
-		timestamp, err := time.Parse(time.RFC3339, strings.SplitN(line, ",", 2)[0])
-		if err != nil {
-			log.Printf("error parsing timestamp: %s", err)
+// MinErrorRateLines is the number of lines read before the error rate is
+// checked while reading, so that a few rejected lines at the start of an input
+// do not stop it.
+const MinErrorRateLines = 1000
+
+// ErrLineTooLong is returned when a line is longer than the maximum line
+// length and is not truncated.
+var ErrLineTooLong = errors.New("line too long")
+
+// ErrTooManyRejected is returned when the share of lines rejected by the
+// parser exceeds the maximum error rate.
+var ErrTooManyRejected = errors.New("too many rejected lines")
+
+// LineError is an error that ended reading at a line of the input.
+type LineError struct {
+	// Position of the line in the input, starting at 1.
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+type Options struct {
+	// Parser used to read the timestamp of each line. Defaults to the CSV
+	// format.
+	Parser processor.Parser
+	// Length of the time ranges lines are grouped by. Defaults to one hour.
+	Window window.Window
+	// Time zone in which windows are aligned. When nil, the offset written in
+	// each line's timestamp is used.
+	Location *time.Location
+	// Merge lines that belong to a window already seen earlier in the input
+	// into that window's batch instead of starting a new batch. Batches are
+	// then only sent once the whole input has been read, in chronological
+	// order.
+	Merge bool
+	// Skip the first record of the input, which holds column names.
+	SkipHeader bool
+	// Length in bytes of the longest line read. Defaults to
+	// DefaultMaxLineLength.
+	MaxLineLength int
+	// Cut lines longer than MaxLineLength instead of failing with
+	// ErrLineTooLong.
+	Truncate bool
+	// When not nil, filled with the lines rejected by the parser.
+	Report *processor.Report
+	// Number of rejected lines kept in the report.
+	Samples int
+	// Share of rejected lines, between 0 and 1, above which the input is
+	// rejected with ErrTooManyRejected. It is checked as lines are read once
+	// MinErrorRateLines are, and once the input is read. Ignored when 0.
+	MaxErrorRate float64
+	// Number of bytes of lines after which a window is split into another
+	// batch, so that busy windows are processed in parallel and not held whole
+	// in memory. Windows are not split when 0.
+	ChunkSize int
+}
+
+// ReadLogBatches sends the lines read by scanner grouped by window. When the
+// input cannot be read or a line is too long, it stops reading, sends the
+// lines read so far and returns the reason. When too many lines are rejected
+// before the end of the input, the window being read is not sent. Once ctx is
+// done, it returns without sending anything more.
+func ReadLogBatches(ctx context.Context, scanner *bufio.Scanner, logEntriesChan chan<- processor.Batch, options Options) error {
+	// Batches seen so far when merging, keyed by the Unix time of their start
+	var batches map[int64]*processor.Batch
+	if options.Merge {
+		batches = make(map[int64]*processor.Batch)
+	}
+
+	lines := newLineScanner(scanner, options)
+	var current *processor.Batch
+	seq := 0
+	unparsable := 0
+	for lines.scan(ctx) {
+		if !lines.parsed {
+			unparsable++
+			continue
+		}
+
+		start := lines.start
+		if current == nil || !current.Start.Equal(start) {
+			if current != nil {
+				current.Unparsable += unparsable
+				unparsable = 0
+			}
+			if options.Merge {
+				current = batches[start.Unix()]
+				if current == nil {
+					current = &processor.Batch{Start: start, End: options.Window.End(start), Entries: processor.NewEntries()}
+					batches[start.Unix()] = current
+				}
+			} else {
+				if current != nil {
+					current.Last = true
+					if !send(ctx, logEntriesChan, *current) {
+						return ctx.Err()
+					}
+					seq++
+				}
+				current = &processor.Batch{Seq: seq, Start: start, End: options.Window.End(start), Entries: processor.NewEntries()}
+			}
+		}
+		current.Entries = append(current.Entries, lines.entry)
+		current.Size += len(lines.line)
+
+		if !options.Merge && options.ChunkSize > 0 && current.Size >= options.ChunkSize {
+			// Send the part read so far to keep the window from being held whole
+			current.Unparsable += unparsable
+			unparsable = 0
+			if !send(ctx, logEntriesChan, *current) {
+				return ctx.Err()
+			}
+			current = &processor.Batch{Seq: seq, Part: current.Part + 1, Start: current.Start, End: current.End, Entries: processor.NewEntries()}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Error that ended reading, once the lines read so far have been sent
+	readErr := lines.err()
+	if readErr == nil {
+		readErr = CheckErrorRate(lines.report, options.MaxErrorRate)
+	} else if errors.Is(readErr, ErrTooManyRejected) {
+		// The input is rejected rather than cut
+		return readErr
+	}
+	if current == nil {
+		return readErr
+	}
+	current.Unparsable += unparsable
+
+	if !options.Merge {
+		current.Last = true
+		if !send(ctx, logEntriesChan, *current) {
+			return ctx.Err()
+		}
+		return readErr
+	}
+
+	starts := make([]int64, 0, len(batches))
+	for start := range batches {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i] < starts[j]
+	})
+	for i, start := range starts {
+		for _, part := range splitWindow(*batches[start], options.ChunkSize) {
+			part.Seq = i
+			if !send(ctx, logEntriesChan, part) {
+				return ctx.Err()
+			}
+		}
+	}
+	return readErr
+}
+
+// CheckErrorRate returns ErrTooManyRejected when the share of lines rejected
+// in report is above maxErrorRate, unless maxErrorRate is 0.
+func CheckErrorRate(report *processor.Report, maxErrorRate float64) error {
+	if maxErrorRate > 0 && report.ErrorRate() > maxErrorRate {
+		return fmt.Errorf("%d of %d lines rejected: %w", report.Rejected, report.Lines, ErrTooManyRejected)
+	}
+	return nil
+}
+
+// lineScanner reads the lines of an input and the window of their entry,
+// skipping the header and recording rejected lines in a report.
+type lineScanner struct {
+	scanner       *bufio.Scanner
+	parser        processor.Parser
+	options       Options
+	maxLineLength int
+	report        *processor.Report
+	// Number of records read, the header included
+	lineNumber int
+	// Last line read, its entry if the parser accepted it, and the start of
+	// the window of the entry
+	line   string
+	entry  processor.LogEntry
+	parsed bool
+	start  time.Time
+	// Error that ended reading at a line, such as a line too long
+	stopped error
+}
+
+func newLineScanner(scanner *bufio.Scanner, options Options) *lineScanner {
+	parser := options.Parser
+	if parser == nil {
+		parser, _ = processor.ParserFor("csv")
+	}
+	maxLineLength := options.MaxLineLength
+	if maxLineLength <= 0 {
+		maxLineLength = DefaultMaxLineLength
+	}
+	split := bufio.ScanLines
+	if splitter, ok := parser.(processor.RecordSplitter); ok {
+		split = splitter.Split
+	}
+	if options.Truncate {
+		split = (&truncator{split: split, max: maxLineLength}).Split
+	}
+	scanner.Split(split)
+	// The buffer must hold the line and its line break
+	scanner.Buffer(nil, maxLineLength+2)
+
+	report := options.Report
+	if report == nil {
+		report = &processor.Report{}
+	}
+	return &lineScanner{scanner: scanner, parser: parser, options: options, maxLineLength: maxLineLength, report: report}
+}
+
+// scan reads the next line. It returns false at the end of the input, once
+// ctx is done or when reading failed, as told by err.
+func (s *lineScanner) scan(ctx context.Context) bool {
+	for s.scanner.Scan() {
+		if ctx.Err() != nil {
+			return false
+		}
+		s.lineNumber++
+		if s.options.SkipHeader && s.lineNumber == 1 {
 			continue
 		}
+		s.line = s.scanner.Text()
+		s.report.Lines++
+		if len(s.line) > s.maxLineLength {
+			// Only a line break was still missing when it was read
+			s.stopped = &LineError{Line: s.lineNumber, Err: ErrLineTooLong}
+			return false
+		}
+
+		entry, err := s.parser.Parse(s.line)
+		if err != nil {
+			s.report.Reject(s.lineNumber, s.line, err, s.options.Samples)
+			if s.report.Lines >= MinErrorRateLines {
+				if err := CheckErrorRate(s.report, s.options.MaxErrorRate); err != nil {
+					s.stopped = &LineError{Line: s.lineNumber, Err: err}
+					return false
+				}
+			}
+			s.parsed = false
+			return true
+		}
+		timestamp := entry.Timestamp
+		if s.options.Location != nil {
+			timestamp = timestamp.In(s.options.Location)
+		}
+		s.entry = entry
+		s.parsed = true
+		s.start = s.options.Window.Start(timestamp)
+		return true
+	}
+	return false
+}
+
+// err returns the error that ended reading before the end of the input,
+// other than ctx being done.
+func (s *lineScanner) err() error {
+	if s.stopped != nil {
+		return s.stopped
+	}
+	if err := s.scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			err = ErrLineTooLong
+		}
+		return &LineError{Line: s.lineNumber + 1, Err: err}
+	}
+	return nil
+}
+
+// splitWindow cuts a whole window into parts of about chunkSize bytes, each
+// with an equal share of its entries, which do not share capacity so that each
+// can be reused once counted. The window is not cut when chunkSize is 0.
+func splitWindow(batch processor.Batch, chunkSize int) []processor.Batch {
+	batch.Last = true
+	if chunkSize <= 0 || batch.Size <= chunkSize {
+		return []processor.Batch{batch}
+	}
+
+	n := min((batch.Size+chunkSize-1)/chunkSize, len(batch.Entries))
+	parts := make([]processor.Batch, n)
+	for i := range parts {
+		from, to := len(batch.Entries)*i/n, len(batch.Entries)*(i+1)/n
+		parts[i] = processor.Batch{
+			Part:    i,
+			Start:   batch.Start,
+			End:     batch.End,
+			Entries: batch.Entries[from:to:to],
+			Size:    batch.Size*(i+1)/n - batch.Size*i/n,
+		}
+	}
+	parts[0].Unparsable = batch.Unparsable
+	parts[n-1].Last = true
+	return parts
+}
+
+// send reports whether batch was sent before ctx was done.
+func send(ctx context.Context, logEntriesChan chan<- processor.Batch, batch processor.Batch) bool {
+	select {
+	case logEntriesChan <- batch:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
 
-		entryHour := timestamp.Hour()
-		if lastHour != -1 && entryHour != lastHour {
-			logEntriesChan <- lines
-			lines = nil
+// truncator wraps a split function to cut the records longer than max bytes
+// and skip the rest of their line.
+type truncator struct {
+	split    bufio.SplitFunc
+	max      int
+	skipping bool
+}
+
+func (t *truncator) Split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if t.skipping {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			return len(data), nil, nil
 		}
-		lines = append(lines, line)
-		lastHour = entryHour
+		t.skipping = false
+		return i + 1, nil, nil
 	}
-	if len(lines) > 0 {
-		logEntriesChan <- lines
+
+	advance, token, err = t.split(data, atEOF)
+	if err != nil || token != nil || advance > 0 || len(data) <= t.max {
+		if len(token) > t.max {
+			token = token[:t.max]
+		}
+		return advance, token, err
 	}
+	// The record does not end within the buffer
+	slog.Warn("line truncated", "maxLineLength", t.max)
+	t.skipping = true
+	return t.max, data[:t.max], nil
 }
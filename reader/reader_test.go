@@ -3,13 +3,25 @@ package reader_test
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"loglizer/processor"
 	"loglizer/reader"
+	"os"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
 )
 
-func TestReadHourlyLogBatches(t *testing.T) {
+func TestReadLogBatches(t *testing.T) {
 	// Expecting to receive 3 batches from the mock data
 	const EXPECTED_NB_BATCHES = 3
 
@@ -17,7 +29,7 @@ func TestReadHourlyLogBatches(t *testing.T) {
 	scanner := bufio.NewScanner(strings.NewReader(MockData))
 
 	// Create a channel to capture grouped log entries
-	logEntriesChan := make(chan []string, EXPECTED_NB_BATCHES)
+	logEntriesChan := make(chan processor.Batch, EXPECTED_NB_BATCHES)
 
 	// Redirect log output to prevent cluttering the test output
 	var buf bytes.Buffer
@@ -28,10 +40,10 @@ func TestReadHourlyLogBatches(t *testing.T) {
 	}()
 
 	// Call the function in a goroutine since it sends data to a channel
-	go reader.ReadHourlyLogBatches(scanner, logEntriesChan)
+	go reader.ReadLogBatches(context.Background(), scanner, logEntriesChan, reader.Options{})
 
 	// Create a slice to hold the results received from the channel
-	var results [][]string
+	var results []processor.Batch
 
 	// Collect results from the channel
 	for group := range logEntriesChan {
@@ -47,6 +59,96 @@ func TestReadHourlyLogBatches(t *testing.T) {
 		t.Errorf("Expected 3 batches of log entries, got %d", len(results))
 	}
 
+	// Batches must be numbered in the order they were read
+	for i, group := range results {
+		if group.Seq != i {
+			t.Errorf("Expected batch %d to have sequence number %d, got %d", i, i, group.Seq)
+		}
+	}
+
+}
+
+func TestReadLogBatchesCountsUnparsableLines(t *testing.T) {
+	input := `2019-04-30T12:01:39+02:00,network.go,Network connection established
+not a timestamp,db.go,Transaction failed
+2019-04-30T12:02:03+02:00,tardis.go,TARDIS dematerializing
+2019-04-30T13:01:41+02:00,coffeeMachine.go,Coffee is ready`
+	scanner := bufio.NewScanner(strings.NewReader(input))
+	logEntriesChan := make(chan processor.Batch, 2)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	reader.ReadLogBatches(context.Background(), scanner, logEntriesChan, reader.Options{})
+	close(logEntriesChan)
+
+	var results []processor.Batch
+	for group := range logEntriesChan {
+		results = append(results, group)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 batches of log entries, got %d", len(results))
+	}
+	if len(results[0].Entries) != 2 || results[0].Unparsable != 1 {
+		t.Errorf("Expected 2 entries and 1 unparsable line in the first batch, got %d and %d", len(results[0].Entries), results[0].Unparsable)
+	}
+	if results[1].Start.Hour() != 13 || results[1].Unparsable != 0 {
+		t.Errorf("Expected the second batch to start at 13h without unparsable lines, got %s and %d", results[1].Start, results[1].Unparsable)
+	}
+}
+
+func TestReadLogBatchesCalendarHours(t *testing.T) {
+	input := `2019-04-29T12:01:39+02:00,network.go,Network connection established
+2019-04-30T12:01:42+02:00,db.go,Transaction failed
+2019-04-30T13:02:03+02:00,tardis.go,TARDIS dematerializing
+2019-04-30T12:02:44+02:00,memeGenerator.go,Error: Meme generator ran out of memes
+2019-04-30T10:05:26Z,memeGenerator.go,Error: Meme generator ran out of memes`
+
+	tests := []struct {
+		name     string
+		options  reader.Options
+		expected []string
+	}{
+		{
+			name:     "contiguous",
+			options:  reader.Options{},
+			expected: []string{"2019-04-29T12:00:00+02:00", "2019-04-30T12:00:00+02:00", "2019-04-30T13:00:00+02:00", "2019-04-30T12:00:00+02:00"},
+		},
+		{
+			name:     "merged",
+			options:  reader.Options{Merge: true},
+			expected: []string{"2019-04-29T12:00:00+02:00", "2019-04-30T12:00:00+02:00", "2019-04-30T13:00:00+02:00"},
+		},
+		{
+			name:     "merged in UTC",
+			options:  reader.Options{Location: time.UTC, Merge: true},
+			expected: []string{"2019-04-29T10:00:00Z", "2019-04-30T10:00:00Z", "2019-04-30T11:00:00Z"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scanner := bufio.NewScanner(strings.NewReader(input))
+			logEntriesChan := make(chan processor.Batch, 5)
+
+			reader.ReadLogBatches(context.Background(), scanner, logEntriesChan, test.options)
+			close(logEntriesChan)
+
+			var starts []string
+			for group := range logEntriesChan {
+				if group.Seq != len(starts) {
+					t.Errorf("Expected sequence number %d, got %d", len(starts), group.Seq)
+				}
+				starts = append(starts, group.Start.Format(time.RFC3339))
+			}
+
+			if strings.Join(starts, " ") != strings.Join(test.expected, " ") {
+				t.Errorf("Expected batches starting at %v, got %v", test.expected, starts)
+			}
+		})
+	}
 }
 
 // The first 100 lines of the CSV file
@@ -150,3 +252,284 @@ var MockData = `2019-04-30T12:01:39+02:00,network.go,Network connection establis
 2019-04-30T13:56:56+02:00,db.go,Transaction failed
 2019-04-30T15:00:18+02:00,starTrek.go,Error: Failed to beam up
 2019-04-30T15:00:28+02:00,starTrek.go,Error: Failed to beam up`
+
+func TestReadLogBatchesStopsWhenCancelled(t *testing.T) {
+	input := `2019-04-30T12:01:39+02:00,network.go,Network connection established
+2019-04-30T13:01:42+02:00,db.go,Transaction failed
+2019-04-30T14:02:03+02:00,tardis.go,TARDIS dematerializing`
+	scanner := bufio.NewScanner(strings.NewReader(input))
+	// Nobody receives the batches
+	logEntriesChan := make(chan processor.Batch)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		reader.ReadLogBatches(ctx, scanner, logEntriesChan, reader.Options{})
+		close(done)
+	}()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadLogBatches did not return after cancellation")
+	}
+}
+
+func TestReadLogBatchesLongLines(t *testing.T) {
+	input := "2019-04-30T12:01:39+02:00,network.go,Network connection established\n" +
+		"2019-04-30T12:01:42+02:00,db.go," + strings.Repeat("x", 100) + "\n" +
+		"2019-04-30T12:02:03+02:00,tardis.go,TARDIS dematerializing\n"
+
+	t.Run("error", func(t *testing.T) {
+		scanner := bufio.NewScanner(strings.NewReader(input))
+		logEntriesChan := make(chan processor.Batch, 1)
+
+		err := reader.ReadLogBatches(context.Background(), scanner, logEntriesChan, reader.Options{MaxLineLength: 80})
+		if !errors.Is(err, reader.ErrLineTooLong) || err.Error() != "line 2: line too long" {
+			t.Errorf("Expected a line too long error on line 2, got %v", err)
+		}
+		close(logEntriesChan)
+		// The line read before is still sent
+		if batch := <-logEntriesChan; len(batch.Entries) != 1 {
+			t.Errorf("Expected the first line to be sent, got %+v", batch.Entries)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		scanner := bufio.NewScanner(strings.NewReader(input))
+		logEntriesChan := make(chan processor.Batch, 1)
+
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		defer log.SetOutput(os.Stderr)
+
+		err := reader.ReadLogBatches(context.Background(), scanner, logEntriesChan, reader.Options{MaxLineLength: 80, Truncate: true})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		close(logEntriesChan)
+		batch := <-logEntriesChan
+		// The message of the second line is what is left of 80 bytes
+		if len(batch.Entries) != 3 || len(batch.Entries[1].Message) != 80-len("2019-04-30T12:01:42+02:00,db.go,") || batch.Entries[2].Message != "TARDIS dematerializing" {
+			t.Errorf("Expected the second line to be cut to 80 bytes, got %+v", batch.Entries)
+		}
+	})
+}
+
+func TestReadLogBatchesReport(t *testing.T) {
+	input := `date,file,message
+2019-04-30T12:01:39+02:00,network.go,Network connection established
+not a timestamp,db.go,Transaction failed
+2019-04-30T12:02:03+02:00,tardis.go,TARDIS dematerializing
+malformed`
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	t.Run("report", func(t *testing.T) {
+		scanner := bufio.NewScanner(strings.NewReader(input))
+		logEntriesChan := make(chan processor.Batch, 1)
+		report := &processor.Report{}
+
+		err := reader.ReadLogBatches(context.Background(), scanner, logEntriesChan, reader.Options{SkipHeader: true, Report: report, Samples: 1})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if report.Lines != 4 || report.Rejected != 2 || report.Reasons["invalid timestamp"] != 1 || report.Reasons["malformed"] != 1 {
+			t.Errorf("Expected 2 of 4 lines rejected for different reasons, got %+v", report)
+		}
+		expected := []processor.RejectedLine{{Line: 3, Reason: "invalid timestamp", Text: "not a timestamp,db.go,Transaction failed"}}
+		if !reflect.DeepEqual(report.Samples, expected) {
+			t.Errorf("Expected samples %+v, got %+v", expected, report.Samples)
+		}
+	})
+
+	t.Run("max error rate", func(t *testing.T) {
+		scanner := bufio.NewScanner(strings.NewReader(input))
+		logEntriesChan := make(chan processor.Batch, 1)
+
+		err := reader.ReadLogBatches(context.Background(), scanner, logEntriesChan, reader.Options{SkipHeader: true, MaxErrorRate: 0.4})
+		if !errors.Is(err, reader.ErrTooManyRejected) || err.Error() != "2 of 4 lines rejected: too many rejected lines" {
+			t.Errorf("Expected too many rejected lines, got %v", err)
+		}
+		// The lines read are still sent
+		if len(logEntriesChan) != 1 {
+			t.Errorf("Expected 1 batch, got %d", len(logEntriesChan))
+		}
+	})
+
+	t.Run("max error rate while reading", func(t *testing.T) {
+		rejected := strings.Repeat("not a log line\n", reader.MinErrorRateLines)
+		scanner := bufio.NewScanner(strings.NewReader("2019-04-30T12:01:39+02:00,network.go,Network connection established\n" + rejected + input))
+		logEntriesChan := make(chan processor.Batch, 1)
+
+		err := reader.ReadLogBatches(context.Background(), scanner, logEntriesChan, reader.Options{MaxErrorRate: 0.5})
+		var lineErr *reader.LineError
+		if !errors.As(err, &lineErr) || !errors.Is(err, reader.ErrTooManyRejected) || lineErr.Line != 1000 {
+			t.Errorf("Expected too many rejected lines at line 1000, got %v", err)
+		}
+		// Reading stops, and the window being read is dropped
+		if len(logEntriesChan) != 0 {
+			t.Errorf("Expected no batch, got %d", len(logEntriesChan))
+		}
+	})
+}
+
+func TestReadLogBatchesSplitsWindows(t *testing.T) {
+	input := `2019-04-30T12:01:39+02:00,network.go,Network connection established
+2019-04-30T12:01:42+02:00,db.go,Transaction failed
+2019-04-30T13:02:03+02:00,tardis.go,TARDIS dematerializing
+2019-04-30T12:02:44+02:00,memeGenerator.go,Error: Meme generator ran out of memes
+2019-04-30T12:05:26+02:00,memeGenerator.go,Error: Meme generator ran out of memes`
+
+	tests := []struct {
+		name     string
+		options  reader.Options
+		expected []string
+	}{
+		{
+			// The last part of a window may be empty
+			name:     "contiguous",
+			options:  reader.Options{ChunkSize: 100},
+			expected: []string{"0/0 2", "0/1 last 0", "1/0 last 1", "2/0 2", "2/1 last 0"},
+		},
+		{
+			name:     "merged",
+			options:  reader.Options{ChunkSize: 100, Merge: true},
+			expected: []string{"0/0 1", "0/1 1", "0/2 last 2", "1/0 last 1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scanner := bufio.NewScanner(strings.NewReader(input))
+			logEntriesChan := make(chan processor.Batch, 10)
+
+			if err := reader.ReadLogBatches(context.Background(), scanner, logEntriesChan, test.options); err != nil {
+				t.Fatal(err)
+			}
+			close(logEntriesChan)
+
+			var parts []string
+			for batch := range logEntriesChan {
+				part := fmt.Sprintf("%d/%d", batch.Seq, batch.Part)
+				if batch.Last {
+					part += " last"
+				}
+				parts = append(parts, fmt.Sprintf("%s %d", part, len(batch.Entries)))
+			}
+			if !reflect.DeepEqual(parts, test.expected) {
+				t.Errorf("Expected parts %q, got %q", test.expected, parts)
+			}
+		})
+	}
+}
+
+func TestSplitRanges(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&input, "2019-04-30T12:%02d:39+02:00,network.go,Network connection established\n", i)
+		// A quoted message whose second line reads like a record
+		fmt.Fprintf(&input, "2019-04-30T12:%02d:42+02:00,db.go,\"Transaction failed\n2019-04-30T12:%02d:43+02:00,db.go,rolling back\"\n", i, i)
+	}
+	data := input.String()
+	csv, _ := processor.ParserFor("csv")
+
+	// Offsets at which the records of the input start
+	starts := map[int64]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	scanner.Split(csv.(processor.RecordSplitter).Split)
+	offset := int64(0)
+	for scanner.Scan() {
+		starts[offset] = true
+		offset += int64(len(scanner.Text())) + 1
+	}
+
+	for n := 1; n <= 8; n++ {
+		offsets, err := reader.SplitRanges(strings.NewReader(data), int64(len(data)), n, csv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(offsets) < 2 || len(offsets) > n+1 || offsets[len(offsets)-1] != int64(len(data)) {
+			t.Fatalf("SplitRanges(%d) = %v", n, offsets)
+		}
+		if n > 1 && len(offsets) < 3 {
+			t.Errorf("SplitRanges(%d) = %v, want several ranges", n, offsets)
+		}
+		for _, offset := range offsets[:len(offsets)-1] {
+			if !starts[offset] {
+				t.Errorf("SplitRanges(%d) = %v: %d is not the start of a record", n, offsets, offset)
+			}
+		}
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	line := "2019-04-30T12:01:39+02:00,db.go,Transaction failed\n"
+
+	var gzipped bytes.Buffer
+	for i := 0; i < 2; i++ {
+		// Rotated logs may hold several members
+		writer := gzip.NewWriter(&gzipped)
+		writer.Write([]byte(line))
+		writer.Close()
+	}
+	var zstdData bytes.Buffer
+	zstdWriter, _ := zstd.NewWriter(&zstdData)
+	zstdWriter.Write([]byte(line))
+	zstdWriter.Close()
+	var xzData bytes.Buffer
+	xzWriter, _ := xz.NewWriter(&xzData)
+	xzWriter.Write([]byte(line))
+	xzWriter.Close()
+	// Written by bzip2 -9
+	bzip2Data := []byte{
+		0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0xfc, 0xa8, 0x61, 0x18, 0x00, 0x00,
+		0x09, 0x5b, 0x80, 0x00, 0x10, 0x40, 0x0f, 0x7c, 0x30, 0x04, 0x00, 0x3f, 0xa5, 0x9c, 0x00, 0x20,
+		0x00, 0x50, 0xa3, 0x43, 0x40, 0x00, 0x00, 0x15, 0x3d, 0x4f, 0x53, 0x6a, 0x03, 0xd4, 0x79, 0x23,
+		0x34, 0x9e, 0x45, 0x63, 0xbf, 0x19, 0xf7, 0x41, 0x4f, 0x03, 0x93, 0x45, 0x29, 0x18, 0x2c, 0xf5,
+		0x12, 0xd3, 0x69, 0x00, 0xa3, 0xd9, 0xe9, 0x56, 0x27, 0xb3, 0x4e, 0x22, 0xe3, 0x03, 0x57, 0x8c,
+		0x0b, 0xb9, 0x22, 0x9c, 0x28, 0x48, 0x7e, 0x54, 0x30, 0x8c, 0x00,
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		encoding string
+		expected string
+	}{
+		{"plain", []byte(line), "", line},
+		{"short", []byte("\x1f"), "", "\x1f"},
+		{"gzip", gzipped.Bytes(), "", line + line},
+		{"gzip encoding", gzipped.Bytes(), "GZIP", line + line},
+		{"zstd", zstdData.Bytes(), "", line},
+		{"bzip2", bzip2Data, "", line},
+		{"xz", xzData.Bytes(), "", line},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decompressed, err := reader.Decompress(bytes.NewReader(test.data), test.encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer decompressed.Close()
+			content, err := io.ReadAll(decompressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != test.expected {
+				t.Errorf("Decompress() read %q, want %q", content, test.expected)
+			}
+			compressed := test.expected != string(test.data)
+			if got := reader.IsCompressedAt(bytes.NewReader(test.data)); got != compressed {
+				t.Errorf("IsCompressedAt() = %v, want %v", got, compressed)
+			}
+		})
+	}
+
+	if _, err := reader.Decompress(strings.NewReader(line), "br"); !errors.Is(err, reader.ErrUnsupportedEncoding) {
+		t.Errorf("Decompress() with br failed with %v, want %v", err, reader.ErrUnsupportedEncoding)
+	}
+}
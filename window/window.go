@@ -0,0 +1,147 @@
+package window
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is the length of the time ranges log lines are grouped by. Fixed
+// windows are aligned on midnight, and day and week windows follow the
+// calendar, weeks starting on Monday. The zero value is one hour.
+type Window struct {
+	duration time.Duration
+	unit     unit
+}
+
+type unit int
+
+const (
+	fixed unit = iota
+	day
+	week
+)
+
+var (
+	Hour = Window{duration: time.Hour}
+	Day  = Window{unit: day}
+	Week = Window{unit: week}
+)
+
+// Parse reads a window from "day", "week" or a Go duration such as "5m" or
+// "1h". Durations must be whole seconds and at most 24 hours.
+func Parse(s string) (Window, error) {
+	switch strings.ToLower(s) {
+	case "day", "1d":
+		return Day, nil
+	case "week", "1w":
+		return Week, nil
+	}
+
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return Window{}, fmt.Errorf("invalid window %q: %w", s, err)
+	}
+	if duration < time.Second || duration%time.Second != 0 || duration > 24*time.Hour {
+		return Window{}, fmt.Errorf("invalid window %q: must be whole seconds between 1s and 24h", s)
+	}
+	return Window{duration: duration}, nil
+}
+
+func (w Window) String() string {
+	switch w.unit {
+	case day:
+		return "day"
+	case week:
+		return "week"
+	}
+	return w.size().String()
+}
+
+// Start returns the beginning of the window containing t, in t's location.
+func (w Window) Start(t time.Time) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch w.unit {
+	case day:
+		return midnight
+	case week:
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		return midnight.AddDate(0, 0, -daysSinceMonday)
+	}
+
+	// Elapsed time is measured in absolute time, so on days with a DST change
+	// windows keep their length and the repeated hour is not folded into one.
+	size := w.size()
+	return midnight.Add(t.Sub(midnight) / size * size)
+}
+
+// End returns the end of the window beginning at start. Fixed windows that do
+// not divide a day evenly are cut short at midnight.
+func (w Window) End(start time.Time) time.Time {
+	switch w.unit {
+	case day:
+		return start.AddDate(0, 0, 1)
+	case week:
+		return start.AddDate(0, 0, 7)
+	}
+
+	end := start.Add(w.size())
+	nextMidnight := time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, start.Location())
+	if end.After(nextMidnight) {
+		return nextMidnight
+	}
+	return end
+}
+
+// Format renders the start of a window as the date, MMDDYYYY, and the time of
+// day with as much precision as the window needs. The time of day is empty
+// for day and week windows. When the clock is set back for DST, it is
+// followed by the UTC offset so the two occurrences of the repeated hour can
+// be told apart, e.g. 02+02:00 and 02+01:00.
+func (w Window) Format(start time.Time) (string, string) {
+	date := start.Format("01022006")
+	if w.unit != fixed {
+		return date, ""
+	}
+
+	var layout string
+	size := w.size()
+	switch {
+	case size%time.Hour == 0:
+		layout = "15"
+	case size%time.Minute == 0:
+		layout = "15:04"
+	default:
+		layout = "15:04:05"
+	}
+	if isRepeated(start) {
+		layout += "Z07:00"
+	}
+	return date, start.Format(layout)
+}
+
+// isRepeated reports whether the wall clock time of t occurs twice in its
+// location because of a DST change. Changes are assumed to be more than a day
+// apart, so the offsets a day before and after cover both sides.
+func isRepeated(t time.Time) bool {
+	_, offset := t.Zone()
+	for _, other := range []time.Time{t.AddDate(0, 0, -1), t.AddDate(0, 0, 1)} {
+		_, otherOffset := other.Zone()
+		if otherOffset == offset {
+			continue
+		}
+		// The same wall clock time under the other offset
+		twin := t.Add(time.Duration(offset-otherOffset) * time.Second)
+		if _, twinOffset := twin.Zone(); twinOffset == otherOffset {
+			return true
+		}
+	}
+	return false
+}
+
+func (w Window) size() time.Duration {
+	if w.duration == 0 {
+		return time.Hour
+	}
+	return w.duration
+}
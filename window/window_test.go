@@ -0,0 +1,131 @@
+package window
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParse(t *testing.T) {
+	valid := map[string]string{
+		"1m":   "1m0s",
+		"15m":  "15m0s",
+		"1h":   "1h0m0s",
+		"day":  "day",
+		"Week": "week",
+	}
+	for input, expected := range valid {
+		w, err := Parse(input)
+		if err != nil {
+			t.Errorf("Parse(%q) returned an error: %v", input, err)
+			continue
+		}
+		if w.String() != expected {
+			t.Errorf("Parse(%q) = %s, want %s", input, w, expected)
+		}
+	}
+
+	for _, input := range []string{"", "0s", "-5m", "500ms", "1.5s", "25h", "month"} {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("Parse(%q) should have returned an error", input)
+		}
+	}
+}
+
+func TestWindows(t *testing.T) {
+	cet := time.FixedZone("CET", 2*60*60)
+	// A Tuesday
+	timestamp := time.Date(2019, 4, 30, 12, 37, 46, 0, cet)
+
+	tests := []struct {
+		window        string
+		expectedStart time.Time
+		expectedEnd   time.Time
+		expectedLabel string
+	}{
+		{"1m", time.Date(2019, 4, 30, 12, 37, 0, 0, cet), time.Date(2019, 4, 30, 12, 38, 0, 0, cet), "04302019,12:37"},
+		{"5m", time.Date(2019, 4, 30, 12, 35, 0, 0, cet), time.Date(2019, 4, 30, 12, 40, 0, 0, cet), "04302019,12:35"},
+		{"15m", time.Date(2019, 4, 30, 12, 30, 0, 0, cet), time.Date(2019, 4, 30, 12, 45, 0, 0, cet), "04302019,12:30"},
+		{"1h", time.Date(2019, 4, 30, 12, 0, 0, 0, cet), time.Date(2019, 4, 30, 13, 0, 0, 0, cet), "04302019,12"},
+		{"30s", time.Date(2019, 4, 30, 12, 37, 30, 0, cet), time.Date(2019, 4, 30, 12, 38, 0, 0, cet), "04302019,12:37:30"},
+		{"7h", time.Date(2019, 4, 30, 7, 0, 0, 0, cet), time.Date(2019, 4, 30, 14, 0, 0, 0, cet), "04302019,07"},
+		{"day", time.Date(2019, 4, 30, 0, 0, 0, 0, cet), time.Date(2019, 5, 1, 0, 0, 0, 0, cet), "04302019,"},
+		{"week", time.Date(2019, 4, 29, 0, 0, 0, 0, cet), time.Date(2019, 5, 6, 0, 0, 0, 0, cet), "04292019,"},
+	}
+
+	for _, test := range tests {
+		w, err := Parse(test.window)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned an error: %v", test.window, err)
+		}
+		start := w.Start(timestamp)
+		if !start.Equal(test.expectedStart) {
+			t.Errorf("%s: Start() = %s, want %s", test.window, start, test.expectedStart)
+		}
+		if end := w.End(start); !end.Equal(test.expectedEnd) {
+			t.Errorf("%s: End() = %s, want %s", test.window, end, test.expectedEnd)
+		}
+		if date, timeOfDay := w.Format(start); date+","+timeOfDay != test.expectedLabel {
+			t.Errorf("%s: Format() = %q, %q, want %q", test.window, date, timeOfDay, test.expectedLabel)
+		}
+	}
+}
+
+func TestFixedWindowEndsAtMidnight(t *testing.T) {
+	w, _ := Parse("7h")
+	start := w.Start(time.Date(2019, 4, 30, 22, 0, 0, 0, time.UTC))
+
+	if expected := time.Date(2019, 4, 30, 21, 0, 0, 0, time.UTC); !start.Equal(expected) {
+		t.Errorf("Start() = %s, want %s", start, expected)
+	}
+	if end, expected := w.End(start), time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC); !end.Equal(expected) {
+		t.Errorf("End() = %s, want %s", end, expected)
+	}
+}
+
+func TestZeroWindowIsOneHour(t *testing.T) {
+	var w Window
+	timestamp := time.Date(2019, 4, 30, 12, 37, 46, 0, time.UTC)
+
+	if start := w.Start(timestamp); !start.Equal(Hour.Start(timestamp)) {
+		t.Errorf("Start() = %s, want %s", start, Hour.Start(timestamp))
+	}
+}
+
+func TestFormatDSTChanges(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatalf("LoadLocation returned an error: %v", err)
+	}
+	w, _ := Parse("1h")
+
+	// Clocks go back from 03:00 CEST to 02:00 CET on October 27, 2019
+	var fallBack []string
+	for hour := 23; hour <= 28; hour++ {
+		start := w.Start(time.Date(2019, 10, 26, hour, 30, 0, 0, time.UTC).In(paris))
+		date, timeOfDay := w.Format(start)
+		fallBack = append(fallBack, date+","+timeOfDay)
+	}
+	expected := []string{"10272019,01", "10272019,02+02:00", "10272019,02+01:00", "10272019,03", "10272019,04", "10272019,05"}
+	for i := range expected {
+		if fallBack[i] != expected[i] {
+			t.Errorf("Format() = %v, want %v", fallBack, expected)
+			break
+		}
+	}
+
+	// Clocks go forward from 02:00 CET to 03:00 CEST on March 31, 2019
+	var springForward []string
+	for hour := 23; hour <= 26; hour++ {
+		start := w.Start(time.Date(2019, 3, 30, hour, 30, 0, 0, time.UTC).In(paris))
+		date, timeOfDay := w.Format(start)
+		springForward = append(springForward, date+","+timeOfDay)
+	}
+	expected = []string{"03312019,00", "03312019,01", "03312019,03", "03312019,04"}
+	for i := range expected {
+		if springForward[i] != expected[i] {
+			t.Errorf("Format() = %v, want %v", springForward, expected)
+			break
+		}
+	}
+}